@@ -34,6 +34,7 @@ import (
 	"crypto/md5"
 	"errors"
 	"fmt"
+	"strings"
 )
 
 // Auth is implemented by an SMTP authentication mechanism.
@@ -63,9 +64,15 @@ type ServerInfo struct {
 	Auth []string // advertised authentication mechanisms
 }
 
+// cleartextMechs are the mechanisms sending credentials in clear, which
+// Client.Auth refuses on connections without TLS.
+var cleartextMechs = map[string]bool{"PLAIN": true, "LOGIN": true, "XOAUTH2": true}
+
 type plainAuth struct {
 	identity, username, password string
 	host                         string
+	resp                         []byte
+	err                          error
 }
 
 // PlainAuth returns an Auth that implements the PLAIN authentication
@@ -73,19 +80,36 @@ type plainAuth struct {
 // The returned Auth uses the given username and password to authenticate
 // on TLS connections to host and act as identity. Usually identity will be
 // left blank to act as username.
+// Credentials containing NUL, CR or LF are rejected with
+// ErrInvalidCredentials when authentication starts.
 func PlainAuth(identity, username, password, host string) Auth {
-	return &plainAuth{identity, username, password, host}
+	resp, err := plainResponse(identity, username, password)
+	return &plainAuth{identity, username, password, host, resp, err}
+}
+
+// plainResponse assembles the PLAIN message authzid NUL authcid NUL passwd,
+// refusing values that would corrupt it or break out of the AUTH command.
+func plainResponse(identity, username, password string) ([]byte, error) {
+	for _, v := range []string{identity, username, password} {
+		if strings.ContainsAny(v, "\x00\r\n") {
+			return nil, ErrInvalidCredentials
+		}
+	}
+	return []byte(identity + "\x00" + username + "\x00" + password), nil
 }
 
 func (a *plainAuth) Start(server *ServerInfo) (string, []byte, error) {
+	if a.err != nil {
+		return "", nil, a.err
+	}
 	if !server.TLS {
-		return "", nil, errors.New("unencrypted connection")
+		// named, so the refusal is reported for the mechanism
+		return "PLAIN", nil, ErrInsecureAuth
 	}
 	if server.Name != a.host {
 		return "", nil, errors.New("wrong host name")
 	}
-	resp := []byte(a.identity + "\x00" + a.username + "\x00" + a.password)
-	return "PLAIN", resp, nil
+	return "PLAIN", a.resp, nil
 }
 
 func (a *plainAuth) Next(fromServer []byte, more bool) ([]byte, error) {
@@ -96,6 +120,51 @@ func (a *plainAuth) Next(fromServer []byte, more bool) ([]byte, error) {
 	return nil, nil
 }
 
+type loginAuth struct {
+	username, password string
+	host               string
+	// number of prompts answered
+	step int
+}
+
+// LoginAuth returns an Auth that implements the non-standard LOGIN
+// mechanism, which some legacy and Microsoft servers offer exclusively.
+// Like PlainAuth, it only sends the credentials over TLS connections to
+// host.
+func LoginAuth(username, password, host string) Auth {
+	return &loginAuth{username: username, password: password, host: host}
+}
+
+func (a *loginAuth) Start(server *ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "LOGIN", nil, ErrInsecureAuth
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	a.step = 0
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	a.step++
+	// answer by prompt, or by order for empty or unusual prompts
+	switch prompt := strings.ToLower(strings.TrimSpace(string(fromServer))); {
+	case strings.HasPrefix(prompt, "user"):
+		return []byte(a.username), nil
+	case strings.HasPrefix(prompt, "pass"):
+		return []byte(a.password), nil
+	case a.step == 1:
+		return []byte(a.username), nil
+	case a.step == 2:
+		return []byte(a.password), nil
+	}
+	return nil, errors.New("unexpected server challenge")
+}
+
 type cramMD5Auth struct {
 	username, secret string
 }
@@ -121,3 +190,86 @@ func (a *cramMD5Auth) Next(fromServer []byte, more bool) ([]byte, error) {
 	}
 	return nil, nil
 }
+
+type xoauth2Auth struct {
+	resp []byte
+	err  error
+}
+
+// XOAuth2Auth returns an Auth that implements the XOAUTH2 mechanism used
+// by Gmail and Office 365, authenticating username with an OAuth 2.0
+// bearer accessToken. It fails without sending the token if the server
+// does not advertise XOAUTH2. Values containing control characters such
+// as ^A, CR or LF are rejected with ErrInvalidCredentials.
+func XOAuth2Auth(username, accessToken string) Auth {
+	for _, v := range []string{username, accessToken} {
+		if strings.ContainsAny(v, "\x00\x01\r\n") {
+			return &xoauth2Auth{err: ErrInvalidCredentials}
+		}
+	}
+	return &xoauth2Auth{resp: []byte("user=" + username + "\x01auth=Bearer " + accessToken + "\x01\x01")}
+}
+
+func (a *xoauth2Auth) Start(server *ServerInfo) (string, []byte, error) {
+	if a.err != nil {
+		return "", nil, a.err
+	}
+	if !stringInArray("XOAUTH2", server.Auth) {
+		return "", nil, fmt.Errorf("%w: AUTH XOAUTH2", ErrNotSupported)
+	}
+	return "XOAUTH2", a.resp, nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// the challenge is a JSON error description; an empty response
+		// makes the server send the final error reply
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+// SASLClient is the client side of a SASL mechanism provided by an
+// external library, e.g. for GSSAPI, driven by SASLAuth.
+type SASLClient interface {
+	// Step processes the challenge of the server, nil for the initial
+	// response, and returns the response. done reports that the client
+	// considers the exchange complete.
+	Step(challenge []byte) (response []byte, done bool, err error)
+}
+
+type saslAuth struct {
+	mech   string
+	client SASLClient
+}
+
+// SASLAuth returns an Auth that runs the SASL mechanism mech, e.g.
+// "GSSAPI", by passing the challenges of the server to client. Its
+// response to the nil challenge is sent as initial response with AUTH
+// unless it is nil.
+func SASLAuth(mech string, client SASLClient) Auth {
+	return &saslAuth{mech, client}
+}
+
+func (a *saslAuth) Start(server *ServerInfo) (string, []byte, error) {
+	resp, _, err := a.client.Step(nil)
+	if err != nil {
+		return "", nil, err
+	}
+	return a.mech, resp, nil
+}
+
+func (a *saslAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	resp, _, err := a.client.Step(fromServer)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		// the server waits for a response, even an empty one
+		resp = []byte{}
+	}
+	return resp, nil
+}
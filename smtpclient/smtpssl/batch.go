@@ -0,0 +1,163 @@
+//Copyright 2015 NF Design UG (haftungsbeschraenkt)
+//All right reserved.
+
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+
+//  http://www.apache.org/licenses/LICENSE-2.0
+
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package smtpssl
+
+// Sending many messages over a bounded number of connections
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultBatchConns is the number of connections SendBatch uses if
+// SendOptions.MaxConns is not set.
+const DefaultBatchConns = 4
+
+// OutgoingMessage is a message sent by SendBatch.
+type OutgoingMessage struct {
+	From string
+	To   []string
+	Msg  []byte
+}
+
+// SendBatch sends messages to the server at addr over up to opts.MaxConns
+// connections in parallel, each of which is reused for several messages.
+// The connections are set up as by SendMailWithOptions and authenticated
+// with a, which may be nil, once; opts.ConnDialer may choose the Dialer
+// of each connection. The result of each message is returned
+// at its index, with the error in SendResult.Err; a failed message does
+// not affect the others. Messages not sent before ctx is done fail with
+// ctx.Err(), as do those in transfer, whose connections are aborted.
+// opts may be nil.
+func SendBatch(ctx context.Context, addr string, a Auth, messages []OutgoingMessage, opts *SendOptions) []SendResult {
+	if opts == nil {
+		opts = &SendOptions{}
+	}
+	conns := opts.MaxConns
+	if conns <= 0 {
+		conns = DefaultBatchConns
+	}
+	if conns > len(messages) {
+		conns = len(messages)
+	}
+	var (
+		mu     sync.Mutex
+		dialed int
+	)
+	pool := &Pool{
+		New: func() (*Client, error) {
+			// a stalled server must not outlast ctx
+			connOpts := *opts
+			connOpts.ClientOptions = append(append([]Option(nil), opts.ClientOptions...), WithContext(ctx))
+			if opts.ConnDialer != nil {
+				mu.Lock()
+				d := opts.ConnDialer(dialed)
+				dialed++
+				mu.Unlock()
+				connOpts.ClientOptions = append(connOpts.ClientOptions, WithDialer(d))
+			}
+			c, err := connect(addr, &connOpts)
+			if err == nil {
+				err = c.authenticate(a, nil, opts, &SendResult{})
+			}
+			if err != nil {
+				if c != nil {
+					c.Close()
+				}
+				return nil, sendError(err)
+			}
+			return c, nil
+		},
+		// each message gets its own connection attempt
+		Reconnect: ReconnectFunc(func(int) time.Duration { return 0 }),
+		MaxConns:  conns,
+	}
+	defer pool.Close()
+
+	results := make([]SendResult, len(messages))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range next {
+				results[j] = pool.send(messages[j], opts)
+			}
+		}()
+	}
+	for i := range messages {
+		if err := ctx.Err(); err != nil {
+			results[i].Err = err
+			continue
+		}
+		select {
+		case next <- i:
+		case <-ctx.Done():
+			results[i].Err = ctx.Err()
+		}
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
+
+// send submits m in a transaction on a Client of the pool. The Client is
+// returned to the pool unless the transaction failed for other reasons
+// than a rejection by the server.
+func (p *Pool) send(m OutgoingMessage, opts *SendOptions) (res SendResult) {
+	start := time.Now()
+	defer func() { res.Elapsed = time.Since(start) }()
+	c, err := p.Get()
+	if err != nil {
+		res.Err = err
+		return
+	}
+	mark, written := len(c.log.w.smtplog), c.log.written
+	before := c.PhaseTimings()
+	res.AuthMechanism = c.authMech
+	if state, ok := c.TLSConnectionState(); ok {
+		res.TLS = &state
+	}
+
+	err = c.transaction(m.From, m.To, bytes.NewReader(m.Msg), 0, opts, &res)
+	reuse := err == nil
+	var serr *SMTPError
+	if errors.As(err, &serr) {
+		reuse = c.Reset() == nil
+	}
+
+	if log := c.log.w.smtplog; mark <= len(log) {
+		res.Transcript = append([]byte(nil), log[mark:]...)
+	}
+	res.BytesSent = c.log.written - written
+	res.PhaseTimings = c.PhaseTimings()
+	for phase, d := range before {
+		if res.PhaseTimings[phase] -= d; res.PhaseTimings[phase] == 0 {
+			delete(res.PhaseTimings, phase)
+		}
+	}
+	res.Err = sendError(err)
+	if reuse {
+		p.Put(c)
+	} else {
+		p.Discard(c)
+	}
+	return
+}
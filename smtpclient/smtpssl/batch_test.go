@@ -0,0 +1,119 @@
+//Copyright 2015 NF Design UG (haftungsbeschraenkt)
+//All right reserved.
+
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+
+//  http://www.apache.org/licenses/LICENSE-2.0
+
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package smtpssl
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendBatch(t *testing.T) {
+	d := &seqDialer{[]string{`220 hello world
+250 mx.example.com
+250 Sender OK
+250 Receiver OK
+354 Go ahead
+250 2.0.0 Ok: queued as 1A2B
+250 Sender OK
+550 5.1.1 No such user
+250 Reset OK
+250 Sender OK
+250 Receiver OK
+354 Go ahead
+250 2.0.0 Ok: queued as 3C4D
+221 Bye
+`}}
+	messages := []OutgoingMessage{
+		{"a@example.com", []string{"b@example.com"}, []byte("one\r\n")},
+		{"a@example.com", []string{"unknown@example.com"}, []byte("two\r\n")},
+		{"a@example.com", []string{"c@example.com"}, []byte("three\r\n")},
+	}
+	res := SendBatch(context.Background(), "mx.example.com:25", nil, messages, &SendOptions{ClientOptions: []Option{WithDialer(d)}, MaxConns: 1})
+	if len(res) != 3 {
+		t.Fatalf("Got %d results", len(res))
+	}
+	if res[0].Err != nil || res[0].QueueID != "1A2B" || res[2].Err != nil || res[2].QueueID != "3C4D" {
+		t.Errorf("Unexpected results %+v, %+v", res[0], res[2])
+	}
+	if res[1].Err == nil || len(res[1].Recipients) != 1 || res[1].Recipients[0].Code != 550 {
+		t.Errorf("Expected rejected recipient, got %+v", res[1])
+	}
+	if !strings.HasPrefix(string(res[2].Transcript), "C: MAIL FROM:<a@example.com>") {
+		t.Errorf("Transcript not limited to the message:\n%s", res[2].Transcript)
+	}
+}
+
+func TestSendBatchCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d := &seqDialer{}
+	res := SendBatch(ctx, "mx.example.com:25", nil, []OutgoingMessage{{"a@example.com", []string{"b@example.com"}, nil}}, &SendOptions{ClientOptions: []Option{WithDialer(d)}})
+	if len(res) != 1 || res[0].Err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %+v", res)
+	}
+}
+
+func TestSendBatchCanceledStalled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	done := make(chan []SendResult, 1)
+	go func() {
+		msg := []OutgoingMessage{{"user@example.com", []string{"rcpt@example.com"}, []byte("body\r\n")}}
+		done <- SendBatch(ctx, "mx.example.com:25", nil, msg, &SendOptions{ClientOptions: []Option{WithDialer(stallDataDialer{})}})
+	}()
+	select {
+	case res := <-done:
+		if !errors.Is(res[0].Err, context.Canceled) {
+			t.Errorf("Expected context.Canceled, got %v", res[0].Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SendBatch still blocked after ctx was canceled")
+	}
+}
+
+func TestSendBatchConnDialer(t *testing.T) {
+	server := "220 hello world\n250 mx.example.com\n250 Sender OK\n250 Receiver OK\n354 Go ahead\n250 Data OK\n221 Bye\n"
+	var conns []int
+	opts := &SendOptions{
+		MaxConns: 1,
+		ConnDialer: func(n int) Dialer {
+			conns = append(conns, n)
+			return &fakeDialer{server: server}
+		},
+	}
+	// the first message fails without a reply, so its connection is
+	// discarded and the second message needs a new one
+	messages := []OutgoingMessage{
+		{"a@example.com", []string{"b@example.com"}, []byte("one\r\n")},
+		{"a@example.com", []string{"b@example.com"}, []byte("two\r\n")},
+	}
+	opts.ClientOptions = []Option{WithCommandHook(func(verb, args string) (string, error) {
+		if verb == "DATA" && len(conns) == 1 {
+			return "", errors.New("injected")
+		}
+		return strings.TrimSpace(verb + " " + args), nil
+	})}
+	res := SendBatch(context.Background(), "mx.example.com:25", nil, messages, opts)
+	if res[0].Err == nil || res[1].Err != nil {
+		t.Fatalf("Unexpected errors %v, %v", res[0].Err, res[1].Err)
+	}
+	if len(conns) != 2 || conns[0] != 0 || conns[1] != 1 {
+		t.Errorf("Dialers requested for connections %v", conns)
+	}
+}
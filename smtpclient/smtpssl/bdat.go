@@ -0,0 +1,134 @@
+//Copyright 2015 NF Design UG (haftungsbeschraenkt)
+//All right reserved.
+
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+
+//  http://www.apache.org/licenses/LICENSE-2.0
+
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package smtpssl
+
+// Message transfer with BDAT (RFC 3030 CHUNKING)
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// bdatChunkSize is the size of the BDAT chunks Bdat sends.
+const bdatChunkSize = 1 << 20
+
+// Bdat transfers the message with BDAT commands instead of DATA, which
+// avoids the dot-stuffing overhead for large messages. It returns a
+// writer collecting the data into chunks of up to 1 MiB, each sent with
+// a BDAT command; closing it sends the rest with BDAT LAST. The data is
+// sent as is, so it has to use CRLF line endings.
+// A call to Bdat must be preceded by one or more calls to Rcpt. If the
+// server does not advertise CHUNKING, an error wrapping ErrNotSupported
+// is returned without issuing a command. Once a chunk is rejected, the
+// writer fails and the transaction has to be reset.
+func (c *Client) Bdat() (io.WriteCloser, error) {
+	if ok, _ := c.Extension("CHUNKING"); !ok {
+		return nil, fmt.Errorf("%w: CHUNKING", ErrNotSupported)
+	}
+	if c.RequireTLSForData && !c.tls {
+		return nil, ErrTLSRequiredForData
+	}
+	if c.bareLF {
+		// the chunk sizes would not match the converted data
+		return nil, errors.New("BDAT can not be used with bare LF line endings")
+	}
+	return &bdatWriter{c: c, size: bdatChunkSize, start: time.Now()}, nil
+}
+
+type bdatWriter struct {
+	c *Client
+	// data of the next chunk and its maximum size
+	buf  []byte
+	size int
+	// reply to the last chunk
+	msg string
+	// the first error, returned by all further calls
+	err error
+	// when the writer was created
+	start time.Time
+}
+
+func (w *bdatWriter) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	var n int
+	for n < len(b) {
+		k := min(w.size-len(w.buf), len(b)-n)
+		w.buf = append(w.buf, b[n:n+k]...)
+		n += k
+		if len(w.buf) == w.size {
+			if w.err = w.send(false); w.err != nil {
+				return n, w.err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close sends the remaining data with BDAT LAST, completing the
+// transaction.
+func (w *bdatWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.send(true)
+	w.c.addPhase(PhaseData, w.start)
+	if w.err == nil {
+		w.c.inTransaction = false
+		// refuse further writes
+		w.err = errors.New("BDAT writer closed")
+		return nil
+	}
+	return w.err
+}
+
+// send issues a BDAT command with the buffered data, passing the command
+// line to CommandHook.
+func (w *bdatWriter) send(last bool) error {
+	t := w.c.Text
+	line := "BDAT " + strconv.Itoa(len(w.buf))
+	if last {
+		line += " LAST"
+	}
+	line, err := w.c.hook(line)
+	if err != nil {
+		return err
+	}
+	id := t.Next()
+	t.StartRequest(id)
+	t.W.WriteString(line + "\r\n")
+	t.W.Write(w.buf)
+	err = t.W.Flush()
+	t.EndRequest(id)
+	if err != nil {
+		return err
+	}
+	if w.c.DataTee != nil {
+		w.c.DataTee.Write(w.buf)
+	}
+	w.buf = w.buf[:0]
+
+	t.StartResponse(id)
+	defer t.EndResponse(id)
+	code, msg, err := t.ReadResponse(250)
+	w.c.noteReply(code, msg)
+	w.msg = msg
+	return err
+}
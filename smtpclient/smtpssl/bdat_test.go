@@ -0,0 +1,67 @@
+//Copyright 2015 NF Design UG (haftungsbeschraenkt)
+//All right reserved.
+
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+
+//  http://www.apache.org/licenses/LICENSE-2.0
+
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package smtpssl
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestBdat(t *testing.T) {
+	c, out := newFakeClient("250 2.0.0 8 octets received\n250 2.0.0 8 octets received\n250 2.0.0 Ok: queued as 4F3C21E1A3\n")
+	c.ext = map[string]string{"CHUNKING": ""}
+	w, err := c.Bdat()
+	if err != nil {
+		t.Fatalf("Bdat failed: %s", err)
+	}
+	w.(*bdatWriter).size = 8
+	for _, s := range []string{"Subj", "ect: a\r\n", "\r\n.body\r\n"} {
+		if _, err := io.WriteString(w, s); err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+	if actual, expected := out(), "BDAT 8\nSubject:BDAT 8\n a\n\n.bBDAT 5 LAST\nody\n"; actual != expected {
+		t.Errorf("Got %q, expected %q", actual, expected)
+	}
+	if queueID(w.(*bdatWriter).msg) != "4F3C21E1A3" {
+		t.Errorf("Got reply %q", w.(*bdatWriter).msg)
+	}
+
+	c, _ = newFakeClient("")
+	if _, err := c.Bdat(); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Expected ErrNotSupported, got %v", err)
+	}
+}
+
+func TestBdatRejectedChunk(t *testing.T) {
+	c, out := newFakeClient("552 5.3.4 Message too big\n")
+	c.ext = map[string]string{"CHUNKING": ""}
+	w, _ := c.Bdat()
+	w.(*bdatWriter).size = 4
+	if _, err := io.WriteString(w, "too much data"); err == nil {
+		t.Fatalf("Expected the rejected chunk to fail the write")
+	}
+	if err := w.Close(); err == nil {
+		t.Fatalf("Expected Close to fail")
+	}
+	if expected := "BDAT 4\ntoo "; out() != expected {
+		t.Errorf("Expected no further chunks after the rejection, %q", expected)
+	}
+}
@@ -0,0 +1,157 @@
+//Copyright 2015 NF Design UG (haftungsbeschraenkt)
+//All right reserved.
+
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+
+//  http://www.apache.org/licenses/LICENSE-2.0
+
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package smtpssl
+
+// Bounding sessions by a context
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// WithContext makes the Client abort blocking operations, starting with
+// dialing and the greeting, once ctx is done, see SetContext.
+func WithContext(ctx context.Context) Option {
+	return func(c *Client) {
+		c.ctx = ctx
+	}
+}
+
+// DialContext is like Dial, but dialing, the greeting and all later
+// commands are aborted once ctx is done, e.g. the context of an HTTP
+// request submitting the message.
+func DialContext(ctx context.Context, addr string, opts ...Option) (*Client, *ByteLogger, error) {
+	return Dial(addr, append(opts[:len(opts):len(opts)], WithContext(ctx))...)
+}
+
+// SetContext bounds the following operations of the Client by ctx,
+// replacing a previously set context. The deadline of ctx becomes the
+// deadline of the connection, and once ctx is done, reads and writes in
+// progress are interrupted and the operations return ctx.Err(). The
+// connection is in an undefined state afterwards and should be closed.
+// A nil ctx removes the bound.
+func (c *Client) SetContext(ctx context.Context) {
+	c.ctx = ctx
+	c.watch(c.Conn())
+}
+
+// watch sets the deadline of conn to that of c.ctx and interrupts I/O on
+// conn once c.ctx is done.
+func (c *Client) watch(conn net.Conn) {
+	c.unwatch()
+	conn.SetDeadline(c.deadline())
+	if c.ctx != nil {
+		c.stopWatch = context.AfterFunc(c.ctx, func() {
+			// a deadline in the past unblocks pending reads and writes
+			conn.SetDeadline(time.Unix(1, 0))
+		})
+	}
+}
+
+// unwatch stops interrupting I/O once the context is done.
+func (c *Client) unwatch() {
+	if c.stopWatch != nil {
+		c.stopWatch()
+		c.stopWatch = nil
+	}
+}
+
+// DataWithDeadline is like Data, but the DATA command, the message
+// transfer and the reply read by Close fail with an error wrapping
+// os.ErrDeadlineExceeded once t has passed, e.g. when the server stalls
+// while receiving the message. The deadline of the context set with
+// SetContext applies instead if it is earlier. Closing the writer
+// restores the deadline of the context.
+func (c *Client) DataWithDeadline(t time.Time) (io.WriteCloser, error) {
+	if d := c.deadline(); !d.IsZero() && d.Before(t) {
+		t = d
+	}
+	c.conn.SetDeadline(t)
+	w, err := c.Data()
+	if err != nil {
+		c.conn.SetDeadline(c.deadline())
+		return nil, err
+	}
+	w.(*dataCloser).restoreDeadline = true
+	return w, nil
+}
+
+// deadline returns the deadline of c.ctx, the zero time if there is none.
+func (c *Client) deadline() time.Time {
+	if c.ctx == nil {
+		return time.Time{}
+	}
+	d, _ := c.ctx.Deadline()
+	return d
+}
+
+// context returns c.ctx, or an empty context if none is set.
+func (c *Client) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// ctxConn reports the error of the context of the Client instead of the
+// I/O error once the context is done.
+type ctxConn struct {
+	net.Conn
+	c *Client
+}
+
+func (cc *ctxConn) Read(b []byte) (int, error) {
+	if err := cc.err(); err != nil {
+		return 0, err
+	}
+	n, err := cc.Conn.Read(b)
+	return n, cc.translate(err)
+}
+
+func (cc *ctxConn) Write(b []byte) (int, error) {
+	if err := cc.err(); err != nil {
+		return 0, err
+	}
+	n, err := cc.Conn.Write(b)
+	return n, cc.translate(err)
+}
+
+// translate returns the error of the context instead of err, an I/O
+// error, if the context is done. The connection deadline may pass just
+// before the context notices its own.
+func (cc *ctxConn) translate(err error) error {
+	if err == nil {
+		return nil
+	}
+	if ctxErr := cc.err(); ctxErr != nil {
+		return ctxErr
+	}
+	if d := cc.c.deadline(); !d.IsZero() && errors.Is(err, os.ErrDeadlineExceeded) && !time.Now().Before(d) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+func (cc *ctxConn) err() error {
+	if cc.c.ctx == nil {
+		return nil
+	}
+	return cc.c.ctx.Err()
+}
@@ -0,0 +1,189 @@
+//Copyright 2015 NF Design UG (haftungsbeschraenkt)
+//All right reserved.
+
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+
+//  http://www.apache.org/licenses/LICENSE-2.0
+
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package smtpssl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/textproto"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stallDialer connects to a server that greets and then stops replying.
+type stallDialer struct{}
+
+func (stallDialer) Dial(network, addr string) (net.Conn, error) {
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		tc := textproto.NewConn(serverConn)
+		tc.PrintfLine("220 hello world")
+		tc.ReadLine()
+		tc.PrintfLine("250 mx.example.com")
+		for {
+			if _, err := tc.ReadLine(); err != nil {
+				return
+			}
+		}
+	}()
+	return clientConn, nil
+}
+
+// stallDataDialer connects to a server that accepts a message and then
+// stops reading the message data.
+type stallDataDialer struct{}
+
+func (stallDataDialer) Dial(network, addr string) (net.Conn, error) {
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		tc := textproto.NewConn(serverConn)
+		tc.PrintfLine("220 hello world")
+		for _, reply := range []string{"250 mx.example.com", "250 Sender OK", "250 Receiver OK", "354 Go ahead"} {
+			tc.ReadLine()
+			tc.PrintfLine("%s", reply)
+		}
+	}()
+	return clientConn, nil
+}
+
+func TestDataWithDeadline(t *testing.T) {
+	c, _, err := Dial("mx.example.com:25", WithDialer(stallDataDialer{}))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	if err := c.Mail("user@example.com"); err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+	if err := c.Rcpt("rcpt@example.com"); err != nil {
+		t.Fatalf("RCPT failed: %s", err)
+	}
+	w, err := c.DataWithDeadline(time.Now().Add(50 * time.Millisecond))
+	if err != nil {
+		t.Fatalf("DATA failed: %s", err)
+	}
+	_, err = w.Write(bytes.Repeat([]byte("stalled\r\n"), 1<<14))
+	if err == nil {
+		err = w.Close()
+	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Expected os.ErrDeadlineExceeded, got %v", err)
+	}
+}
+
+func TestDialContextDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	c, _, err := DialContext(ctx, "mx.example.com:25", WithDialer(stallDialer{}))
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	defer c.Close()
+	if err := c.Mail("user@example.com"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestSetContextCancel(t *testing.T) {
+	c, _, err := Dial("mx.example.com:25", WithDialer(stallDialer{}))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	c.SetContext(ctx)
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if err := c.Mail("user@example.com"); err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if err := c.Reset(); err != context.Canceled {
+		t.Fatalf("Expected context.Canceled without I/O, got %v", err)
+	}
+}
+
+func TestDialContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := DialContext(ctx, "mx.example.com:25", WithDialer(stallDialer{})); err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+}
+
+// deadlineConn records whether the deadline was set to the past, as done
+// once the context of the Client is done.
+type deadlineConn struct {
+	net.Conn
+	mu          sync.Mutex
+	interrupted bool
+}
+
+func (c *deadlineConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.interrupted = c.interrupted || !t.IsZero() && t.Before(time.Now())
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+type deadlineDialer struct{ conn *deadlineConn }
+
+func (d *deadlineDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := (&fakeDialer{server: "554 No service\n"}).Dial(network, addr)
+	d.conn = &deadlineConn{Conn: conn}
+	return d.conn, err
+}
+
+func TestDialContextUnwatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &deadlineDialer{}
+	if _, _, err := DialContext(ctx, "mx.example.com:25", WithDialer(d)); err == nil {
+		t.Fatal("Expected the greeting to fail")
+	}
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	d.conn.mu.Lock()
+	defer d.conn.mu.Unlock()
+	if d.conn.interrupted {
+		t.Error("Context still watched after the failed dial")
+	}
+}
+
+// earlyDeadlineCtx reports a deadline, but is never done, as a context
+// noticing its deadline only after the connection.
+type earlyDeadlineCtx struct {
+	context.Context
+	deadline time.Time
+}
+
+func (ctx earlyDeadlineCtx) Deadline() (time.Time, bool) { return ctx.deadline, true }
+
+func TestConnDeadlineBeforeContext(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	deadline := time.Now().Add(20 * time.Millisecond)
+	c := &Client{ctx: earlyDeadlineCtx{context.Background(), deadline}}
+	clientConn.SetDeadline(deadline)
+	cc := &ctxConn{Conn: clientConn, c: c}
+	if _, err := cc.Read(make([]byte, 1)); err != context.DeadlineExceeded {
+		t.Errorf("Read: expected context.DeadlineExceeded, got %v", err)
+	}
+	if _, err := cc.Write([]byte("x")); err != context.DeadlineExceeded {
+		t.Errorf("Write: expected context.DeadlineExceeded, got %v", err)
+	}
+}
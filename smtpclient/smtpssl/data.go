@@ -0,0 +1,83 @@
+//Copyright 2015 NF Design UG (haftungsbeschraenkt)
+//All right reserved.
+
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+
+//  http://www.apache.org/licenses/LICENSE-2.0
+
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package smtpssl
+
+// Transfer of message data leaving the body untouched
+
+import "bufio"
+
+// headerDotWriter dot-stuffs message data like the DotWriter of
+// textproto, but only converts bare LF line endings to CRLF in the header
+// section, up to the first empty line. The body is sent as is, so e.g.
+// binary MIME parts with bare LF are not altered.
+type headerDotWriter struct {
+	w      *bufio.Writer
+	inBody bool
+	// length of the current line, excluding CR
+	lineLen int
+	// the last byte written and the one before
+	prev, prev2 byte
+}
+
+func newHeaderDotWriter(w *bufio.Writer) *headerDotWriter {
+	return &headerDotWriter{w: w, prev: '\n', prev2: '\r'}
+}
+
+func (d *headerDotWriter) Write(b []byte) (int, error) {
+	for i, c := range b {
+		if d.prev == '\n' && c == '.' {
+			// lenient servers also take a bare LF as line end
+			if err := d.w.WriteByte('.'); err != nil {
+				return i, err
+			}
+		}
+		if !d.inBody && c == '\n' && d.prev != '\r' {
+			if err := d.w.WriteByte('\r'); err != nil {
+				return i, err
+			}
+			d.prev = '\r'
+		}
+		if err := d.w.WriteByte(c); err != nil {
+			return i, err
+		}
+		switch c {
+		case '\n':
+			if !d.inBody && d.lineLen == 0 {
+				d.inBody = true
+			}
+			d.lineLen = 0
+		case '\r':
+		default:
+			d.lineLen++
+		}
+		d.prev, d.prev2 = c, d.prev
+	}
+	return len(b), nil
+}
+
+// Close terminates the data with CRLF "." CRLF, adding a CRLF first if
+// the data does not end with one.
+func (d *headerDotWriter) Close() error {
+	if d.prev != '\n' || d.prev2 != '\r' {
+		if _, err := d.w.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+	if _, err := d.w.WriteString(".\r\n"); err != nil {
+		return err
+	}
+	return d.w.Flush()
+}
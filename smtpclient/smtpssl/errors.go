@@ -0,0 +1,177 @@
+//Copyright 2015 NF Design UG (haftungsbeschraenkt)
+//All right reserved.
+
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+
+//  http://www.apache.org/licenses/LICENSE-2.0
+
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package smtpssl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"syscall"
+)
+
+var (
+	// ErrTLSRequiredForData is returned by Data when the Client requires
+	// TLS for the message body but the connection is not encrypted.
+	ErrTLSRequiredForData = errors.New("TLS required for message data")
+	// ErrInvalidCredentials is returned when credentials contain
+	// characters that can not be transmitted by the auth mechanism.
+	ErrInvalidCredentials = errors.New("credentials contain invalid control characters")
+	// ErrInsecureAuth is returned by Auth for mechanisms sending the
+	// credentials in clear, such as PLAIN and LOGIN, on a connection
+	// without TLS.
+	ErrInsecureAuth = errors.New("refusing to send credentials over an unencrypted connection")
+	// ErrAuthRequired is returned by the send helpers when the server
+	// requires authentication but no credentials were given.
+	ErrAuthRequired = errors.New("server requires authentication but no credentials given")
+	// ErrTooManyAuthChallenges is returned by Auth when the server sent
+	// more challenges than Client.MaxAuthChallenges allows.
+	ErrTooManyAuthChallenges = errors.New("too many AUTH challenges")
+	// ErrCommandTooLong is returned when a command would exceed the line
+	// length the server has to accept, see Client.Limits.
+	ErrCommandTooLong = errors.New("command line too long")
+	// ErrRecipientRejected is returned by SendIfAccepted when the server
+	// rejected at least one recipient, and by the send helpers when it
+	// rejected all of them with SendOptions.AllowPartial set.
+	ErrRecipientRejected = errors.New("recipient rejected")
+	// ErrTLSRequired is returned by the send helpers when TLS is required
+	// but the server does not offer STARTTLS.
+	ErrTLSRequired = errors.New("TLS required but STARTTLS not offered")
+	// ErrSTARTTLSInjection is returned by StartTLS if the server, or an
+	// attacker in between, sent data after accepting STARTTLS, before
+	// the TLS handshake.
+	ErrSTARTTLSInjection = errors.New("plaintext data received after STARTTLS reply")
+	// ErrSourceRoute is returned by Rcpt for source-routed addresses its
+	// SourceRoutePolicy refuses.
+	ErrSourceRoute = errors.New("source-routed address")
+	// ErrTransactionAlreadyOpen is returned by Mail if the previous
+	// transaction was neither completed nor reset and the Client does not
+	// reset it automatically, see Client.AutoReset.
+	ErrTransactionAlreadyOpen = errors.New("mail transaction already open")
+	// ErrMessageTooLarge is returned by Mail when the declared size of
+	// the message exceeds the limit the server advertised with SIZE.
+	ErrMessageTooLarge = errors.New("message exceeds the size limit of the server")
+	// ErrSMTPUTF8Required is returned by Mail and Rcpt for non-ASCII
+	// addresses if the server does not support SMTPUTF8 or the
+	// transaction was started without it.
+	ErrSMTPUTF8Required = errors.New("non-ASCII address requires SMTPUTF8")
+	// ErrNullMX is returned by SendMailMX for domains publishing a null
+	// MX record, stating that they do not accept mail (RFC 7505).
+	ErrNullMX = errors.New("domain does not accept mail")
+	// ErrNoDomain is returned by SendMailMX for recipient addresses
+	// without a domain to look up mail exchangers for.
+	ErrNoDomain = errors.New("recipient address without domain")
+	// ErrNotSupported is wrapped by the errors of commands requiring an
+	// extension the server does not advertise.
+	ErrNotSupported = errors.New("extension not supported by the server")
+	// ErrConnClosed is returned by Ping if the connection to the server
+	// is no longer usable.
+	ErrConnClosed = errors.New("connection closed")
+	// ErrNetwork wraps the errors of the send helpers that were caused
+	// by the connection to the server rather than by its replies, e.g.
+	// refused connections, timeouts or resets.
+	ErrNetwork = errors.New("network error")
+)
+
+// SMTPError is a reply of the server rejecting a command, as returned by
+// the send helpers. It unwraps to the *textproto.Error of the reply.
+type SMTPError struct {
+	Code int
+	// EnhancedCode is the RFC 3463 status code of the reply, if any.
+	EnhancedCode string
+	Msg          string
+}
+
+func newSMTPError(e *textproto.Error) *SMTPError {
+	return &SMTPError{Code: e.Code, EnhancedCode: enhancedCode(e.Msg), Msg: e.Msg}
+}
+
+func (e *SMTPError) Error() string {
+	return fmt.Sprintf("%03d %s", e.Code, e.Msg)
+}
+
+func (e *SMTPError) Unwrap() error {
+	return &textproto.Error{Code: e.Code, Msg: e.Msg}
+}
+
+// Temporary reports whether the rejection is transient (4yz).
+func (e *SMTPError) Temporary() bool {
+	return e.Code/100 == 4
+}
+
+// AuthError, MailError, RcptError and DataError tell at which stage a
+// session run by the send helpers failed, so callers can branch on it
+// with errors.As. Err is the cause, an *SMTPError for rejections by the
+// server, which errors.As finds through the stage error as well.
+type AuthError struct{ Err error }
+
+func (e *AuthError) Error() string { return "AUTH failed: " + e.Err.Error() }
+func (e *AuthError) Unwrap() error { return e.Err }
+
+// MailError is returned when the MAIL command failed, see AuthError.
+type MailError struct{ Err error }
+
+func (e *MailError) Error() string { return "MAIL failed: " + e.Err.Error() }
+func (e *MailError) Unwrap() error { return e.Err }
+
+// RcptError is returned when the RCPT command for Addr failed, see
+// AuthError.
+type RcptError struct {
+	Addr string
+	Err  error
+}
+
+func (e *RcptError) Error() string { return "RCPT TO " + e.Addr + " failed: " + e.Err.Error() }
+func (e *RcptError) Unwrap() error { return e.Err }
+
+// DataError is returned when transferring the message failed, see
+// AuthError.
+type DataError struct{ Err error }
+
+func (e *DataError) Error() string { return "DATA failed: " + e.Err.Error() }
+func (e *DataError) Unwrap() error { return e.Err }
+
+// stageError is implemented by the stage errors, whose cause sendError
+// already converted.
+type stageError interface{ stage() }
+
+func (*AuthError) stage() {}
+func (*MailError) stage() {}
+func (*RcptError) stage() {}
+func (*DataError) stage() {}
+
+// sendError converts err for the callers of the send helpers: server
+// replies become an *SMTPError, connection failures are wrapped in
+// ErrNetwork.
+func sendError(err error) error {
+	var (
+		serr  *SMTPError
+		perr  *textproto.Error
+		nerr  net.Error
+		stage stageError
+	)
+	switch {
+	case err == nil, errors.As(err, &serr), errors.As(err, &stage):
+		return err
+	case errors.As(err, &perr) && err == error(perr):
+		return newSMTPError(perr)
+	case errors.As(err, &nerr), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return fmt.Errorf("%w: %w", ErrNetwork, err)
+	}
+	return err
+}
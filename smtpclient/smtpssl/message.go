@@ -0,0 +1,188 @@
+//Copyright 2015 NF Design UG (haftungsbeschraenkt)
+//All right reserved.
+
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+
+//  http://www.apache.org/licenses/LICENSE-2.0
+
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package smtpssl
+
+// Building messages and deriving their envelope
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Message is an email built and sent by SendMessage.
+type Message struct {
+	// From is the author, e.g. "Alice <alice@example.com>". Its address
+	// is the envelope sender unless EnvelopeFrom is set.
+	From string
+	// To, Cc and Bcc are the recipients. Bcc is not written to the header.
+	To, Cc, Bcc []string
+	Subject     string
+	// Headers holds further header fields. A Date field is added if
+	// missing. From, To, Cc, Bcc and Subject are taken from the fields
+	// above, so they can not be set here.
+	Headers textproto.MIMEHeader
+	Body    []byte
+	// EnvelopeFrom, if set, is used in MAIL FROM instead of the address
+	// in From, e.g. a VERP address for bounce routing. The From field of
+	// the header is left as authored.
+	EnvelopeFrom string
+}
+
+// Bytes returns m formatted as an RFC 5322 message with CRLF line endings
+// in the header. Header fields are folded to lines of at most 78
+// characters where they contain whitespace to fold at. The body is
+// appended as is, its line endings are left to the writer returned by
+// Data, see WithHeaderOnlyCRLF. Headers with names rejected by
+// CheckHeaders are left out.
+func (m *Message) Bytes() []byte {
+	var b bytes.Buffer
+	writeField := func(name, value string) {
+		b.WriteString(foldField(name, value))
+	}
+	writeField("From", m.From)
+	if len(m.To) > 0 {
+		writeField("To", strings.Join(m.To, ", "))
+	}
+	if len(m.Cc) > 0 {
+		writeField("Cc", strings.Join(m.Cc, ", "))
+	}
+	writeField("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	if m.Headers.Get("Date") == "" {
+		writeField("Date", time.Now().Format(time.RFC1123Z))
+	}
+	keys := make([]string, 0, len(m.Headers))
+	for k := range m.Headers {
+		if checkHeaderName(k) == nil {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range m.Headers[k] {
+			writeField(k, v)
+		}
+	}
+	b.WriteString("\r\n")
+	b.Write(m.Body)
+	return b.Bytes()
+}
+
+// messageFields are the header fields Bytes writes from the fields of
+// Message rather than from Headers.
+var messageFields = []string{"From", "To", "Cc", "Bcc", "Subject"}
+
+// CheckHeaders returns an error if a name in m.Headers is not a valid
+// field name (RFC 5322 section 2.2), e.g. because it contains a line
+// break to inject further fields, or names a field Message sets itself.
+func (m *Message) CheckHeaders() error {
+	for k := range m.Headers {
+		if err := checkHeaderName(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkHeaderName returns an error unless name is a field name Bytes
+// writes from Headers.
+func checkHeaderName(name string) error {
+	if name == "" {
+		return fmt.Errorf("invalid header field name %q", name)
+	}
+	for i := 0; i < len(name); i++ {
+		// printable ASCII except ":", which excludes whitespace
+		if name[i] < 33 || name[i] > 126 || name[i] == ':' {
+			return fmt.Errorf("invalid header field name %q", name)
+		}
+	}
+	for _, f := range messageFields {
+		if strings.EqualFold(name, f) {
+			return fmt.Errorf("header field %s is set from the Message fields", f)
+		}
+	}
+	return nil
+}
+
+// foldField returns the header field name with value, folded at spaces
+// into lines of at most 78 characters where possible (RFC 5322 section
+// 2.2.3), and terminated by CRLF. Line breaks in value are replaced by
+// spaces, so they can not start fields of their own.
+func foldField(name, value string) string {
+	value = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(value)
+	var b strings.Builder
+	line := name + ":"
+	hasWord := false
+	for _, word := range strings.Split(value, " ") {
+		if word != "" && hasWord && len(line)+1+len(word) > 78 {
+			b.WriteString(line + "\r\n")
+			line = ""
+		}
+		line += " " + word
+		hasWord = hasWord || word != ""
+	}
+	b.WriteString(line + "\r\n")
+	return b.String()
+}
+
+// envelope returns the envelope sender and recipients of m.
+func (m *Message) envelope() (from string, to []string, err error) {
+	from = m.EnvelopeFrom
+	if from == "" {
+		if from, err = address(m.From); err != nil {
+			return "", nil, err
+		}
+	}
+	for _, list := range [][]string{m.To, m.Cc, m.Bcc} {
+		for _, s := range list {
+			addr, err := address(s)
+			if err != nil {
+				return "", nil, err
+			}
+			to = append(to, addr)
+		}
+	}
+	return from, to, nil
+}
+
+// address returns the address in s, e.g. "Alice <alice@example.com>".
+func address(s string) (string, error) {
+	a, err := mail.ParseAddress(s)
+	if err != nil {
+		return "", err
+	}
+	return a.Address, nil
+}
+
+// SendMessage sends m like SendMailWithOptions, authenticating with a if
+// not nil. The envelope is derived from m: the sender from EnvelopeFrom
+// or From, the recipients from To, Cc and Bcc. It fails without
+// connecting if CheckHeaders does.
+func SendMessage(addr string, a Auth, m *Message, opts *SendOptions) (*SendResult, error) {
+	if err := m.CheckHeaders(); err != nil {
+		return nil, err
+	}
+	from, to, err := m.envelope()
+	if err != nil {
+		return nil, err
+	}
+	return SendMailWithOptions(addr, a, nil, from, to, m.Bytes(), opts)
+}
@@ -0,0 +1,132 @@
+//Copyright 2015 NF Design UG (haftungsbeschraenkt)
+//All right reserved.
+
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+
+//  http://www.apache.org/licenses/LICENSE-2.0
+
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package smtpssl
+
+import (
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestSendMessageEnvelopeFrom(t *testing.T) {
+	d := &fakeDialer{server: `220 hello world
+250 mx.example.com
+250 Sender OK
+250 Receiver OK
+250 Receiver OK
+354 Go ahead
+250 Data OK
+221 Bye
+`}
+	m := &Message{
+		From:         "Alice <alice@example.com>",
+		To:           []string{"Bob <bob@example.com>"},
+		Bcc:          []string{"carol@example.com"},
+		Subject:      "Hello",
+		Headers:      textproto.MIMEHeader{"Date": {"Mon, 02 Jan 2006 15:04:05 +0000"}},
+		Body:         []byte("Hi Bob\n"),
+		EnvelopeFrom: "bounces+bob=example.com@example.com",
+	}
+	res, err := SendMessage("mx.example.com:25", nil, m, &SendOptions{ClientOptions: []Option{WithDialer(d)}})
+	if err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	log := string(res.Transcript)
+	for _, want := range []string{
+		"C: MAIL FROM:<bounces+bob=example.com@example.com>\r\n",
+		"C: RCPT TO:<bob@example.com>\r\n",
+		"C: RCPT TO:<carol@example.com>\r\n",
+		"C: From: Alice <alice@example.com>\r\nC: To: Bob <bob@example.com>\r\nC: Subject: Hello\r\nC: Date: Mon, 02 Jan 2006 15:04:05 +0000\r\nC: \r\nC: Hi Bob\r\n",
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("Transcript lacks %q:\n%s", want, log)
+		}
+	}
+	if strings.Contains(log, "Bcc") {
+		t.Errorf("Bcc written to the header:\n%s", log)
+	}
+}
+
+func TestMessageBytesBody(t *testing.T) {
+	m := &Message{From: "alice@example.com", Body: []byte("binary\nbody\r\n")}
+	if got := string(m.Bytes()); !strings.HasSuffix(got, "\r\n\r\nbinary\nbody\r\n") {
+		t.Errorf("Body not kept as is: %q", got)
+	}
+}
+
+func TestSendMessageFoldedHeaderOnlyCRLF(t *testing.T) {
+	d := &fakeDialer{server: "220 hello world\n250 mx.example.com\n250 Sender OK\n250 Receiver OK\n354 Go ahead\n250 Data OK\n221 Bye\n"}
+	m := &Message{
+		From:    "alice@example.com",
+		To:      []string{"bob@example.com"},
+		Subject: strings.Repeat("word ", 20),
+		Headers: textproto.MIMEHeader{"Date": {"Mon, 02 Jan 2006 15:04:05 +0000"}},
+		Body:    []byte("binary\nbody\r\n"),
+	}
+	res, err := SendMessage("mx.example.com:25", nil, m, &SendOptions{ClientOptions: []Option{WithDialer(d), WithHeaderOnlyCRLF()}})
+	if err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	// the folded field stays in the header, the body is sent as is
+	log := string(res.Transcript)
+	for _, want := range []string{
+		"C: Subject: " + strings.Repeat("word ", 13) + "word\r\nC:  word",
+		"C: \r\nC: binary\nC: body\r\nC: .\r\n",
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("Transcript lacks %q:\n%s", want, log)
+		}
+	}
+}
+
+func TestMessageHeaderNames(t *testing.T) {
+	for _, h := range []textproto.MIMEHeader{
+		{"X-A\r\nBcc: evil@example.com\r\nX-B": {"v"}},
+		{"X Bad": {"v"}},
+		{"X-Bad:": {"v"}},
+		{"": {"v"}},
+		{"Subject": {"duplicate"}},
+		{"bcc": {"evil@example.com"}},
+	} {
+		d := &fakeDialer{}
+		m := &Message{From: "alice@example.com", To: []string{"bob@example.com"}, Subject: "Hello", Headers: h}
+		if _, err := SendMessage("mx.example.com:25", nil, m, &SendOptions{ClientOptions: []Option{WithDialer(d)}}); err == nil {
+			t.Errorf("Headers %q accepted", h)
+		}
+		if d.addr != "" {
+			t.Errorf("Headers %q: connected", h)
+		}
+		got := string(m.Bytes())
+		if strings.Contains(got, "evil") || strings.Count(got, "Subject:") != 1 || strings.Contains(got, "v\r\n") {
+			t.Errorf("Headers %q written: %q", h, got)
+		}
+	}
+}
+
+func TestFoldField(t *testing.T) {
+	to := strings.Repeat("Recipient <recipient@example.com>, ", 3) + "last@example.com"
+	expected := "To: Recipient <recipient@example.com>, Recipient <recipient@example.com>,\r\n Recipient <recipient@example.com>, last@example.com\r\n"
+	if got := foldField("To", to); got != expected {
+		t.Errorf("Got %q, expected %q", got, expected)
+	}
+	long := strings.Repeat("x", 100)
+	if got := foldField("X-Long", long); got != "X-Long: "+long+"\r\n" {
+		t.Errorf("Got %q, expected the unfoldable value on one line", got)
+	}
+	if got := foldField("Subject", "Hi\r\nBcc: evil@example.com"); got != "Subject: Hi Bcc: evil@example.com\r\n" {
+		t.Errorf("Got %q, expected line breaks removed", got)
+	}
+}
@@ -0,0 +1,152 @@
+//Copyright 2015 NF Design UG (haftungsbeschraenkt)
+//All right reserved.
+
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+
+//  http://www.apache.org/licenses/LICENSE-2.0
+
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package smtpssl
+
+// Direct delivery to the mail exchangers of the recipient domains
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// TLSPolicy tells SendMailMX how to secure the connection to the mail
+// exchangers of a domain.
+type TLSPolicy int
+
+const (
+	// TLSOpportunistic uses STARTTLS if the server offers it, without
+	// verifying the certificate, as is common for MX delivery (RFC 7435).
+	TLSOpportunistic TLSPolicy = iota
+	// TLSRequired fails the delivery to a server not offering STARTTLS or
+	// presenting a certificate that does not verify.
+	TLSRequired
+)
+
+// TLSPolicyLookup returns the TLS policy for a recipient domain, e.g.
+// from a DANE or MTA-STS resolver, along with the configuration to
+// verify the servers with, e.g. with pins derived from TLSA records in
+// VerifyPeerCertificate. A nil config verifies the certificate against
+// the MX host name. An error defers the delivery to the domain.
+type TLSPolicyLookup func(domain string) (TLSPolicy, *tls.Config, error)
+
+// DomainResult is the outcome of the delivery to a recipient domain.
+type DomainResult struct {
+	Domain string
+	// Host is the mail exchanger that accepted the message, or the last
+	// one tried.
+	Host string
+	// Result of the session with Host, nil if none was established.
+	Result *SendResult
+	Err    error
+}
+
+// lookupMX is replaced by tests.
+var lookupMX = net.LookupMX
+
+// SendMailMX delivers msg directly to the mail exchangers of the
+// recipient domains, trying them in order of preference until one
+// accepts the message or rejects it permanently. Domains without MX
+// records are delivered to directly, domains with a null MX fail with
+// ErrNullMX. Sessions are configured by opts, which may be nil; the TLS
+// policy of each domain is taken from opts.TLSPolicy, defaulting to
+// TLSOpportunistic. The results are returned in the order the domains
+// first appear in to. Each address without a domain gets a result of its
+// own with an error wrapping ErrNoDomain.
+func SendMailMX(from string, to []string, msg []byte, opts *SendOptions) []*DomainResult {
+	if opts == nil {
+		opts = &SendOptions{}
+	}
+	var (
+		results []*DomainResult
+		rcpts   = map[string][]string{}
+	)
+	for _, addr := range to {
+		at := strings.LastIndex(addr, "@")
+		if at < 0 || at == len(addr)-1 {
+			results = append(results, &DomainResult{Err: fmt.Errorf("%w: %q", ErrNoDomain, addr)})
+			continue
+		}
+		domain := strings.ToLower(addr[at+1:])
+		if _, ok := rcpts[domain]; !ok {
+			results = append(results, &DomainResult{Domain: domain})
+		}
+		rcpts[domain] = append(rcpts[domain], addr)
+	}
+	for _, r := range results {
+		if r.Err == nil {
+			r.deliver(from, rcpts[r.Domain], msg, opts)
+		}
+	}
+	return results
+}
+
+// deliver sends msg to the recipients in r.Domain.
+func (r *DomainResult) deliver(from string, to []string, msg []byte, opts *SendOptions) {
+	o := *opts
+	o.TLSConfig, o.RequireTLS = &tls.Config{InsecureSkipVerify: true}, false
+	if opts.TLSPolicy != nil {
+		policy, config, err := opts.TLSPolicy(r.Domain)
+		if err != nil {
+			r.Err = err
+			return
+		}
+		if policy == TLSRequired {
+			o.TLSConfig, o.RequireTLS = config, true
+		}
+	}
+
+	hosts, err := mxHosts(r.Domain)
+	if err != nil {
+		r.Err = err
+		return
+	}
+	for _, host := range hosts {
+		r.Host = host
+		r.Result, r.Err = sendMail(net.JoinHostPort(host, "25"), nil, nil, from, to, bytes.NewReader(msg), int64(len(msg)), &o)
+		var serr *SMTPError
+		if r.Err == nil || errors.As(r.Err, &serr) && !serr.Temporary() {
+			return
+		}
+	}
+}
+
+// mxHosts returns the mail exchangers of domain in order of preference,
+// or the domain itself if it has no MX records (RFC 5321 section 5.1),
+// so it is reached at its A or AAAA records.
+func mxHosts(domain string) ([]string, error) {
+	mxs, err := lookupMX(domain)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound || err == nil && len(mxs) == 0 {
+		return []string{domain}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		return nil, fmt.Errorf("%w: null MX for %s", ErrNullMX, domain)
+	}
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	hosts := make([]string, len(mxs))
+	for i, mx := range mxs {
+		hosts[i] = strings.TrimSuffix(mx.Host, ".")
+	}
+	return hosts, nil
+}
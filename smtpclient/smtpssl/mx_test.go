@@ -0,0 +1,132 @@
+//Copyright 2015 NF Design UG (haftungsbeschraenkt)
+//All right reserved.
+
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+
+//  http://www.apache.org/licenses/LICENSE-2.0
+
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package smtpssl
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// mapDialer serves each address with a fake server, refusing unknown ones.
+type mapDialer struct {
+	servers map[string]string
+	dialed  []string
+}
+
+func (d *mapDialer) Dial(network, addr string) (net.Conn, error) {
+	d.dialed = append(d.dialed, addr)
+	server, ok := d.servers[addr]
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+	}
+	return (&fakeDialer{server: server}).Dial(network, addr)
+}
+
+func stubLookupMX(t *testing.T, records map[string][]*net.MX) {
+	orig := lookupMX
+	lookupMX = func(domain string) ([]*net.MX, error) {
+		if mxs, ok := records[domain]; ok {
+			return mxs, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+	}
+	t.Cleanup(func() { lookupMX = orig })
+}
+
+func TestSendMailMXPolicy(t *testing.T) {
+	stubLookupMX(t, map[string][]*net.MX{
+		"plain.example":  {{Host: "mx2.plain.example.", Pref: 20}, {Host: "mx1.plain.example.", Pref: 10}},
+		"secure.example": {{Host: "mx.secure.example.", Pref: 10}},
+	})
+	accepting := "220 hello\n250 mx\n250 Sender OK\n250 Receiver OK\n250 Receiver OK\n354 Go ahead\n250 Data OK\n221 Bye\n"
+	d := &mapDialer{servers: map[string]string{
+		"mx2.plain.example:25": accepting,
+		"mx.secure.example:25": accepting,
+		"implicit.example:25":  strings.Replace(accepting, "250 Receiver OK\n", "", 1),
+	}}
+	var looked []string
+	opts := &SendOptions{
+		ClientOptions: []Option{WithDialer(d)},
+		TLSPolicy: func(domain string) (TLSPolicy, *tls.Config, error) {
+			looked = append(looked, domain)
+			if domain == "secure.example" {
+				return TLSRequired, nil, nil
+			}
+			return TLSOpportunistic, nil, nil
+		},
+	}
+	to := []string{"a@plain.example", "b@Secure.example", "c@plain.example", "d@implicit.example"}
+	res := SendMailMX("from@example.com", to, []byte("body\r\n"), opts)
+
+	if len(res) != 3 {
+		t.Fatalf("Got %d domain results", len(res))
+	}
+	if r := res[0]; r.Domain != "plain.example" || r.Host != "mx2.plain.example" || r.Err != nil || len(r.Result.Recipients) != 2 {
+		t.Errorf("plain.example: %+v", r)
+	}
+	if r := res[1]; r.Domain != "secure.example" || !errors.Is(r.Err, ErrTLSRequired) {
+		t.Errorf("secure.example: %+v", r)
+	}
+	if r := res[2]; r.Host != "implicit.example" || r.Err != nil {
+		t.Errorf("implicit.example: %+v", r)
+	}
+	if got := strings.Join(d.dialed, " "); got != "mx1.plain.example:25 mx2.plain.example:25 mx.secure.example:25 implicit.example:25" {
+		t.Errorf("dialed %s", got)
+	}
+	if got := strings.Join(looked, " "); got != "plain.example secure.example implicit.example" {
+		t.Errorf("looked up policies for %s", got)
+	}
+}
+
+func TestSendMailMXNullMX(t *testing.T) {
+	stubLookupMX(t, map[string][]*net.MX{
+		"nomail.example": {{Host: ".", Pref: 0}},
+	})
+	d := &mapDialer{}
+	res := SendMailMX("from@example.com", []string{"a@nomail.example"}, []byte("body\r\n"), &SendOptions{ClientOptions: []Option{WithDialer(d)}})
+	if len(res) != 1 || !errors.Is(res[0].Err, ErrNullMX) {
+		t.Fatalf("Got %+v, expected ErrNullMX", res[0])
+	}
+	if len(d.dialed) != 0 {
+		t.Errorf("dialed %v", d.dialed)
+	}
+}
+
+func TestSendMailMXSize(t *testing.T) {
+	stubLookupMX(t, map[string][]*net.MX{
+		"small.example": {{Host: "mx.small.example.", Pref: 10}},
+	})
+	d := &mapDialer{servers: map[string]string{"mx.small.example:25": "220 hello\n250-mx\n250 SIZE 4\n221 Bye\n"}}
+	res := SendMailMX("from@example.com", []string{"a@small.example"}, []byte("body\r\n"), &SendOptions{ClientOptions: []Option{WithDialer(d)}})
+	if len(res) != 1 || !errors.Is(res[0].Err, ErrMessageTooLarge) {
+		t.Fatalf("Got %+v, expected ErrMessageTooLarge", res[0])
+	}
+}
+
+func TestSendMailMXNoDomain(t *testing.T) {
+	stubLookupMX(t, map[string][]*net.MX{})
+	d := &mapDialer{}
+	res := SendMailMX("from@example.com", []string{"localpart", "user@"}, []byte("body\r\n"), &SendOptions{ClientOptions: []Option{WithDialer(d)}})
+	if len(res) != 2 || !errors.Is(res[0].Err, ErrNoDomain) || !errors.Is(res[1].Err, ErrNoDomain) {
+		t.Fatalf("Got %+v, expected ErrNoDomain twice", res)
+	}
+	if len(d.dialed) != 0 {
+		t.Errorf("dialed %v", d.dialed)
+	}
+}
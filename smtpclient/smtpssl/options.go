@@ -0,0 +1,214 @@
+//Copyright 2015 NF Design UG (haftungsbeschraenkt)
+//All right reserved.
+
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+
+//  http://www.apache.org/licenses/LICENSE-2.0
+
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package smtpssl
+
+// Options for Dial and NewClient
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"time"
+)
+
+// An Option configures a Client created by Dial or NewClient.
+type Option func(*Client)
+
+// Dialer establishes the connections used by Dial and the send helpers.
+// *net.Dialer implements it, as do SOCKS5 dialers from
+// golang.org/x/net/proxy.
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// WithDialer makes Dial connect using d instead of a zero net.Dialer.
+func WithDialer(d Dialer) Option {
+	return func(c *Client) {
+		c.dialer = d
+	}
+}
+
+// WithNetwork sets the network Dial passes to the Dialer, "tcp" by
+// default. Use "tcp4" or "tcp6" to pin the address family, e.g. for
+// destinations with broken IPv6 connectivity, which would otherwise only
+// be reached after the IPv6 attempt timed out.
+func WithNetwork(network string) Option {
+	return func(c *Client) {
+		c.network = network
+	}
+}
+
+// WithGreetingTimeout makes Dial and NewClient give up if the server
+// does not send its greeting within d after the connection was
+// established, e.g. a host accepting connections but never responding.
+func WithGreetingTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.greetingTimeout = d
+	}
+}
+
+// WithOnTLSHandshake sets Client.OnTLSHandshake, so f is also called for
+// the handshake of a connection using implicit TLS.
+func WithOnTLSHandshake(f func(state tls.ConnectionState)) Option {
+	return func(c *Client) {
+		c.OnTLSHandshake = f
+	}
+}
+
+// WithAsyncQuit sets Client.AsyncQuit, e.g. for the Clients of the send
+// helpers.
+func WithAsyncQuit() Option {
+	return func(c *Client) {
+		c.AsyncQuit = true
+	}
+}
+
+// WithUnsafeLogAuthCredentials sets Client.UnsafeLogAuthCredentials,
+// logging credentials in clear. Only use it for local debugging.
+func WithUnsafeLogAuthCredentials() Option {
+	return func(c *Client) {
+		c.UnsafeLogAuthCredentials = true
+	}
+}
+
+// WithCommandHook sets Client.CommandHook, so it also sees the EHLO or
+// HELO sent while connecting.
+func WithCommandHook(f func(verb, args string) (string, error)) Option {
+	return func(c *Client) {
+		c.CommandHook = f
+	}
+}
+
+// WithLogLimits caps the protocol log of the Client at maxBytes and
+// maxLines, e.g. for long-lived pooled clients, see ByteLogger.MaxBytes
+// and ByteLogger.MaxLines. Zero disables a limit.
+func WithLogLimits(maxBytes, maxLines int) Option {
+	return func(c *Client) {
+		c.logMaxBytes, c.logMaxLines = maxBytes, maxLines
+	}
+}
+
+// WithLogRotation makes the protocol log of the Client pass its content
+// to f whenever it has grown to size bytes, see ByteLogger.RotateSize.
+func WithLogRotation(size int, f func(chunk []byte)) Option {
+	return func(c *Client) {
+		c.logRotateSize, c.logRotate = size, f
+	}
+}
+
+// WithLogWriter makes the protocol log of the Client stream to w instead
+// of being buffered, see ByteLogger.Output.
+func WithLogWriter(w io.Writer) Option {
+	return func(c *Client) {
+		c.logOutput = w
+	}
+}
+
+// WithSourceRoutes sets Client.SourceRoutes.
+func WithSourceRoutes(p SourceRoutePolicy) Option {
+	return func(c *Client) {
+		c.SourceRoutes = p
+	}
+}
+
+// WithAddressSyntax sets Client.AddressSyntax.
+func WithAddressSyntax(s AddressSyntax) Option {
+	return func(c *Client) {
+		c.AddressSyntax = s
+	}
+}
+
+// WithAutoReset sets Client.AutoReset.
+func WithAutoReset() Option {
+	return func(c *Client) {
+		c.AutoReset = true
+	}
+}
+
+// WithStrictEHLO sets Client.StrictEHLO, so it already applies to the
+// greeting sent by Dial and NewClient.
+func WithStrictEHLO() Option {
+	return func(c *Client) {
+		c.StrictEHLO = true
+	}
+}
+
+// WithReEHLODelay sets Client.ReEHLODelay.
+func WithReEHLODelay(d time.Duration) Option {
+	return func(c *Client) {
+		c.ReEHLODelay = d
+	}
+}
+
+// WithLocalName sets Client.LocalName, so it is already announced in the
+// greeting sent by Dial and NewClient. These fail without sending it if
+// the name is invalid as for Hello, e.g. contains a line break.
+func WithLocalName(name string) Option {
+	return func(c *Client) {
+		c.LocalName = name
+	}
+}
+
+// WithDataTee sets Client.DataTee, e.g. for the Clients of the send
+// helpers.
+func WithDataTee(w io.Writer) Option {
+	return func(c *Client) {
+		c.DataTee = w
+	}
+}
+
+// WithHeaderOnlyCRLF makes Data convert bare LF line endings to CRLF
+// only in the message header, up to the first empty line, and send the
+// body unchanged, so e.g. binary MIME parts are not corrupted.
+func WithHeaderOnlyCRLF() Option {
+	return func(c *Client) {
+		c.headerOnlyCRLF = true
+	}
+}
+
+// WithBareLF makes the Client terminate the lines it sends, commands as
+// well as message data, with a bare LF instead of CRLF. This violates
+// RFC 5321 and is only meant for lenient servers and sockets expecting
+// bare LF, such as some LMTP servers.
+func WithBareLF() Option {
+	return func(c *Client) {
+		c.bareLF = true
+	}
+}
+
+// bareLFConn replaces CRLF line endings written to it with LF.
+type bareLFConn struct {
+	net.Conn
+	// a CR ended the previous write
+	cr bool
+}
+
+func (l *bareLFConn) Write(b []byte) (int, error) {
+	out := make([]byte, 0, len(b)+1)
+	for _, c := range b {
+		if l.cr && c != '\n' {
+			out = append(out, '\r')
+		}
+		l.cr = c == '\r'
+		if !l.cr {
+			out = append(out, c)
+		}
+	}
+	if _, err := l.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,298 @@
+//Copyright 2015 NF Design UG (haftungsbeschraenkt)
+//All right reserved.
+
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+
+//  http://www.apache.org/licenses/LICENSE-2.0
+
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package smtpssl
+
+// ESMTP parameters for the MAIL and RCPT commands (RFC 5321 section 4.1.2)
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Param is a single ESMTP parameter appended to a MAIL or RCPT command.
+// An empty Value sends the keyword on its own.
+type Param struct {
+	Keyword string
+	Value   string
+}
+
+// MailOptions holds optional parameters for the MAIL command.
+type MailOptions struct {
+	// Size is the size of the message in octets, declared as SIZE=
+	// if the server supports the SIZE extension (RFC 1870). Zero
+	// declares nothing.
+	Size int64
+	// AuthSender is sent as AUTH= parameter (RFC 4954) if the server
+	// advertises AUTH, asserting the authenticated submitter of a relayed
+	// message.
+	AuthSender string
+	// AuthUnknown sends AUTH=<> instead, stating that the submitter is
+	// unknown or not trusted, which servers may treat differently from a
+	// MAIL command without the parameter. It takes precedence over
+	// AuthSender.
+	AuthUnknown bool
+	// Return asks for the full message, ReturnFull, or only its header,
+	// ReturnHeaders, to be included in delivery status notifications,
+	// sent as RET= if the server supports DSN (RFC 3461).
+	Return string
+	// EnvID is an envelope identifier of the sender reported back in
+	// delivery status notifications, sent as ENVID= if the server
+	// supports DSN, e.g. to match them to the message.
+	EnvID string
+	// UTF8 sends the SMTPUTF8 parameter (RFC 6531), required to use
+	// non-ASCII addresses in the transaction. Mail sets it on its own if
+	// from is a non-ASCII address.
+	UTF8 bool
+	// RequireTLS sends the REQUIRETLS parameter (RFC 8689), see
+	// Client.MailRequireTLS.
+	RequireTLS bool
+	// Extra parameters appended after the ones handled by this package,
+	// e.g. proprietary X- parameters required by some relays. Keywords are
+	// sent verbatim, values are xtext encoded (RFC 3461).
+	Extra []Param
+}
+
+// Values of MailOptions.Return.
+const (
+	ReturnFull    = "FULL"
+	ReturnHeaders = "HDRS"
+)
+
+// Values of RcptOptions.Notify. NotifyNever can not be combined with the
+// others.
+const (
+	NotifySuccess = "SUCCESS"
+	NotifyFailure = "FAILURE"
+	NotifyDelay   = "DELAY"
+	NotifyNever   = "NEVER"
+)
+
+// RcptOptions holds optional parameters for the RCPT command.
+type RcptOptions struct {
+	// Notify lists the DSN conditions (SUCCESS, FAILURE, DELAY or NEVER)
+	// a delivery status notification is requested for (RFC 3461).
+	Notify []string
+	// ORCPT is the original recipient address reported in notifications.
+	ORCPT string
+	// Extra parameters, see MailOptions.Extra.
+	Extra []Param
+}
+
+// checkNotify returns an error unless notify is a valid list of DSN
+// conditions for the NOTIFY parameter.
+func checkNotify(notify []string) error {
+	for _, n := range notify {
+		switch n {
+		case NotifySuccess, NotifyFailure, NotifyDelay:
+		case NotifyNever:
+			if len(notify) > 1 {
+				return fmt.Errorf("NOTIFY value %s combined with others", NotifyNever)
+			}
+		default:
+			return fmt.Errorf("invalid NOTIFY value %q", n)
+		}
+	}
+	return nil
+}
+
+// formatParams returns params as a string of " KEYWORD=value" pairs
+// suitable for appending to a MAIL or RCPT command.
+func formatParams(params []Param) (string, error) {
+	var s string
+	for _, p := range params {
+		if !validKeyword(p.Keyword) {
+			return "", fmt.Errorf("invalid ESMTP parameter keyword %q", p.Keyword)
+		}
+		s += " " + p.Keyword
+		if p.Value != "" {
+			s += "=" + xtext(p.Value)
+		}
+	}
+	return s, nil
+}
+
+// validKeyword reports whether k is an esmtp-keyword:
+// (ALPHA / DIGIT) *(ALPHA / DIGIT / "-")
+func validKeyword(k string) bool {
+	if k == "" || k[0] == '-' {
+		return false
+	}
+	for i := 0; i < len(k); i++ {
+		b := k[i]
+		if !('a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' || b == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// xtext encodes s as defined in RFC 3461 section 4: printable ASCII
+// except "+" and "=" is kept, everything else becomes "+" and two
+// upper case hex digits.
+func xtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if '!' <= c && c <= '~' && c != '+' && c != '=' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "+%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// Limits holds limits the server advertised in its EHLO response or
+// implied by the extensions it supports.
+type Limits struct {
+	// MailLine and RcptLine are the maximum lengths of the MAIL and RCPT
+	// command lines in octets, CRLF included: 512 (RFC 5321), raised for
+	// the parameters of SIZE (RFC 1870), DSN (RFC 3461) and AUTH (RFC 4954).
+	MailLine, RcptLine int
+	// MailMax, RcptMax and RcptDomainMax are the transaction limits
+	// advertised with the LIMITS extension (RFC 9422), 0 if not advertised.
+	MailMax, RcptMax, RcptDomainMax int
+	// MessageSize is the maximum message size in octets advertised with
+	// the SIZE extension (RFC 1870), 0 if not advertised or unlimited.
+	MessageSize int64
+}
+
+// Limits returns the limits for commands sent to the server.
+func (c *Client) Limits() Limits {
+	l := Limits{MailLine: 512, RcptLine: 512}
+	if ok, args := c.Extension("SIZE"); ok {
+		l.MailLine += 26
+		if n, err := strconv.ParseInt(args, 10, 64); err == nil && n > 0 {
+			l.MessageSize = n
+		}
+	}
+	if ok, _ := c.Extension("DSN"); ok {
+		l.MailLine += 100
+		l.RcptLine += 500
+	}
+	if ok, _ := c.Extension("AUTH"); ok {
+		l.MailLine += 500
+	}
+	if ok, args := c.Extension("LIMITS"); ok {
+		for _, f := range strings.Fields(args) {
+			kv := strings.SplitN(f, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			n, err := strconv.Atoi(kv[1])
+			if err != nil || n < 0 {
+				continue
+			}
+			switch strings.ToUpper(kv[0]) {
+			case "MAILMAX":
+				l.MailMax = n
+			case "RCPTMAX":
+				l.RcptMax = n
+			case "RCPTDOMAINMAX":
+				l.RcptDomainMax = n
+			}
+		}
+	}
+	return l
+}
+
+// checkLine returns an error wrapping ErrCommandTooLong if line, with its
+// terminating CRLF, exceeds max octets.
+func checkLine(line string, max int) error {
+	if n := len(line) + 2; n > max {
+		return fmt.Errorf("%w (%d octets, limit %d)", ErrCommandTooLong, n, max)
+	}
+	return nil
+}
+
+// SourceRoutePolicy tells Rcpt how to handle source-routed addresses
+// such as "@relay.example:user@example.com", which RFC 5321 deprecates;
+// servers should ignore the route but many reject such addresses.
+type SourceRoutePolicy int
+
+const (
+	// SourceRouteKeep sends addresses unchanged.
+	SourceRouteKeep SourceRoutePolicy = iota
+	// SourceRouteStrip removes the route and sends only the mailbox.
+	SourceRouteStrip
+	// SourceRouteReject refuses source-routed addresses.
+	SourceRouteReject
+)
+
+// applySourceRoutePolicy returns addr handled according to p. Malformed
+// routes can not be stripped and are refused as well.
+func applySourceRoutePolicy(addr string, p SourceRoutePolicy) (string, error) {
+	if p == SourceRouteKeep || !strings.HasPrefix(addr, "@") {
+		return addr, nil
+	}
+	if p == SourceRouteReject {
+		return "", fmt.Errorf("%w: %q", ErrSourceRoute, addr)
+	}
+	route, mailbox, ok := strings.Cut(addr, ":")
+	if ok {
+		for _, hop := range strings.Split(route, ",") {
+			if len(hop) < 2 || hop[0] != '@' || strings.ContainsAny(hop[1:], "@ ") {
+				ok = false
+			}
+		}
+	}
+	if !ok || !strings.Contains(mailbox, "@") {
+		return "", fmt.Errorf("%w: malformed %q", ErrSourceRoute, addr)
+	}
+	return mailbox, nil
+}
+
+// AddressSyntax tells Mail and Rcpt how to write the address after
+// "FROM:" and "TO:". Only AddressBracketed conforms to RFC 5321, the
+// others exist for non-compliant servers.
+type AddressSyntax int
+
+const (
+	// AddressBracketed sends "MAIL FROM:<user@example.com>".
+	AddressBracketed AddressSyntax = iota
+	// AddressBare sends "MAIL FROM:user@example.com".
+	AddressBare
+	// AddressSpaceBare sends "MAIL FROM: user@example.com".
+	AddressSpaceBare
+	// AddressSpaceBracketed sends "MAIL FROM: <user@example.com>".
+	AddressSpaceBracketed
+)
+
+// formatPath returns addr written according to s for use after "FROM:"
+// or "TO:". The null reverse-path is always sent as "<>".
+func formatPath(addr string, s AddressSyntax) string {
+	if addr != "" && (s == AddressBare || s == AddressSpaceBare) {
+		if s == AddressSpaceBare {
+			return " " + addr
+		}
+		return addr
+	}
+	if s == AddressSpaceBare || s == AddressSpaceBracketed {
+		return " <" + addr + ">"
+	}
+	return "<" + addr + ">"
+}
+
+// isASCII reports whether s consists of ASCII characters only.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
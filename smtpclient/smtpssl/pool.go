@@ -0,0 +1,225 @@
+//Copyright 2015 NF Design UG (haftungsbeschraenkt)
+//All right reserved.
+
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+
+//  http://www.apache.org/licenses/LICENSE-2.0
+
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package smtpssl
+
+// Reusing connections to a single server
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrReconnectDelayed is returned by Pool.Get while the pool's
+	// ReconnectStrategy holds back new connection attempts.
+	ErrReconnectDelayed = errors.New("reconnect delayed after failed connection attempts")
+	// ErrPoolExhausted is returned by Pool.Get in FailFast mode if
+	// MaxConns connections are open.
+	ErrPoolExhausted = errors.New("connection limit reached")
+)
+
+// ReconnectStrategy decides when a Pool may try to connect again after
+// connection attempts failed.
+type ReconnectStrategy interface {
+	// Delay returns how long to wait before the next connection attempt
+	// after the given number of consecutive failures (at least 1).
+	Delay(failures int) time.Duration
+}
+
+// ReconnectFunc is an adapter to use an ordinary function as
+// ReconnectStrategy, e.g. a circuit breaker returning a long cool-down
+// once a threshold of failures is reached.
+type ReconnectFunc func(failures int) time.Duration
+
+// Delay returns f(failures).
+func (f ReconnectFunc) Delay(failures int) time.Duration {
+	return f(failures)
+}
+
+// ExponentialBackoff is a ReconnectStrategy doubling the delay with every
+// consecutive failure, starting at Initial and capped at Max. A Max of 0
+// leaves the delay uncapped.
+type ExponentialBackoff struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+// Delay implements ReconnectStrategy.
+func (b ExponentialBackoff) Delay(failures int) time.Duration {
+	d := b.Initial
+	for i := 1; i < failures && (b.Max <= 0 || d < b.Max) && d <= math.MaxInt64/2; i++ {
+		d *= 2
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+	return d
+}
+
+// DefaultReconnectStrategy is used by a Pool without a ReconnectStrategy.
+var DefaultReconnectStrategy ReconnectStrategy = ExponentialBackoff{time.Second, time.Minute}
+
+// A Pool keeps Clients connected to a single server for reuse.
+// It is safe for concurrent use.
+type Pool struct {
+	// New returns a new Client, ready to start a mail transaction.
+	New func() (*Client, error)
+	// Reconnect decides when New is called again after it failed.
+	// If nil, DefaultReconnectStrategy is used.
+	Reconnect ReconnectStrategy
+	// MaxConns limits the number of Clients connected to the server at
+	// the same time, both in use and idle. Zero means no limit.
+	MaxConns int
+	// FailFast makes Get return ErrPoolExhausted instead of waiting for
+	// a Client to be returned when MaxConns is reached.
+	FailFast bool
+	// MaxIdle makes Get close Clients that were idle for longer instead
+	// of returning them, as servers drop connections without traffic
+	// after a while (RFC 5321 suggests 5 minutes). Zero keeps them.
+	MaxIdle time.Duration
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	idle     []idleClient
+	open     int
+	failures int
+	retryAt  time.Time
+}
+
+// idleClient is a Client in the pool since it was returned at since.
+type idleClient struct {
+	c     *Client
+	since time.Time
+}
+
+// Get returns an idle Client from the pool or connects a new one.
+// If MaxConns Clients are connected, Get waits until one is returned by
+// Put or Discard, unless FailFast is set.
+// While the ReconnectStrategy delays further attempts after failures,
+// Get returns ErrReconnectDelayed without connecting.
+func (p *Pool) Get() (*Client, error) {
+	p.mu.Lock()
+	if p.cond == nil {
+		p.cond = sync.NewCond(&p.mu)
+	}
+	for {
+		if n := len(p.idle); n > 0 {
+			ic := p.idle[n-1]
+			p.idle = p.idle[:n-1]
+			if p.MaxIdle > 0 && time.Since(ic.since) > p.MaxIdle {
+				p.open--
+				p.mu.Unlock()
+				ic.c.Close()
+				p.mu.Lock()
+				continue
+			}
+			p.mu.Unlock()
+			return ic.c, nil
+		}
+		if p.MaxConns <= 0 || p.open < p.MaxConns {
+			break
+		}
+		if p.FailFast {
+			p.mu.Unlock()
+			return nil, ErrPoolExhausted
+		}
+		p.cond.Wait()
+	}
+	if p.failures > 0 && time.Now().Before(p.retryAt) {
+		p.mu.Unlock()
+		return nil, ErrReconnectDelayed
+	}
+	p.open++
+	p.mu.Unlock()
+
+	c, err := p.New()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.release()
+		p.failures++
+		strategy := p.Reconnect
+		if strategy == nil {
+			strategy = DefaultReconnectStrategy
+		}
+		p.retryAt = time.Now().Add(strategy.Delay(p.failures))
+		return nil, err
+	}
+	p.failures = 0
+	return c, nil
+}
+
+// Put returns c to the pool for reuse by a later Get. c must not be used
+// by the caller afterwards. Replies to pipelined commands still in flight
+// are read first, and a mail transaction left open is aborted with RSET.
+// Clients whose server announced to close the connection or that failed
+// either step are discarded instead.
+func (p *Pool) Put(c *Client) {
+	if c.Closing() || c.drain(drainTimeout) != nil {
+		p.Discard(c)
+		return
+	}
+	if c.inTransaction && c.Reset() != nil {
+		p.Discard(c)
+		return
+	}
+	p.mu.Lock()
+	p.idle = append(p.idle, idleClient{c, time.Now()})
+	if p.cond != nil {
+		p.cond.Signal()
+	}
+	p.mu.Unlock()
+}
+
+// Discard closes c, which was obtained from Get but can not be reused,
+// e.g. after a network error, and frees its connection slot.
+func (p *Pool) Discard(c *Client) {
+	c.Close()
+	p.mu.Lock()
+	p.release()
+	p.mu.Unlock()
+}
+
+// release frees a connection slot. p.mu must be held.
+func (p *Pool) release() {
+	p.open--
+	if p.cond != nil {
+		p.cond.Signal()
+	}
+}
+
+// Close quits all idle Clients in the pool.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.open -= len(idle)
+	if p.cond != nil {
+		p.cond.Broadcast()
+	}
+	p.mu.Unlock()
+
+	var err error
+	for _, ic := range idle {
+		if qerr := ic.c.Quit(); qerr != nil && err == nil {
+			err = qerr
+		}
+	}
+	return err
+}
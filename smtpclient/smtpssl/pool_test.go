@@ -0,0 +1,222 @@
+//Copyright 2015 NF Design UG (haftungsbeschraenkt)
+//All right reserved.
+
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+
+//  http://www.apache.org/licenses/LICENSE-2.0
+
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package smtpssl
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	b := ExponentialBackoff{time.Second, 10 * time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, d := range expected {
+		if got := b.Delay(i + 1); got != d {
+			t.Errorf("Delay(%d) = %v, expected %v", i+1, got, d)
+		}
+	}
+
+	uncapped := ExponentialBackoff{Initial: time.Second}
+	expected = []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second}
+	for i, d := range expected {
+		if got := uncapped.Delay(i + 1); got != d {
+			t.Errorf("uncapped Delay(%d) = %v, expected %v", i+1, got, d)
+		}
+	}
+	if got := uncapped.Delay(100); got <= 0 {
+		t.Errorf("uncapped Delay(100) = %v, expected a positive delay", got)
+	}
+}
+
+func TestPoolReconnect(t *testing.T) {
+	var dials int
+	down := errors.New("connection refused")
+	p := &Pool{
+		New: func() (*Client, error) {
+			dials++
+			if dials <= 3 {
+				return nil, down
+			}
+			c, _ := newFakeClient("221 OK\n")
+			return c, nil
+		},
+		// circuit breaker: retry immediately twice, then cool down
+		Reconnect: ReconnectFunc(func(failures int) time.Duration {
+			if failures < 3 {
+				return 0
+			}
+			return time.Hour
+		}),
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := p.Get(); err != down {
+			t.Fatalf("Get #%d: expected dial error, got %v", i, err)
+		}
+	}
+	if _, err := p.Get(); err != ErrReconnectDelayed {
+		t.Fatalf("Expected ErrReconnectDelayed, got %v", err)
+	}
+	if dials != 3 {
+		t.Fatalf("Expected pool to stop dialing after 3 failures, dialed %d times", dials)
+	}
+
+	p.retryAt = time.Now()
+	c, err := p.Get()
+	if err != nil {
+		t.Fatalf("Get after cool-down failed: %s", err)
+	}
+	p.Put(c)
+	if c2, _ := p.Get(); c2 != c {
+		t.Fatalf("Expected idle client to be reused")
+	}
+	p.Put(c)
+	if err := p.Close(); err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+}
+
+func TestPoolMaxConns(t *testing.T) {
+	p := &Pool{
+		New: func() (*Client, error) {
+			c, _ := newFakeClient("")
+			return c, nil
+		},
+		MaxConns: 2,
+		FailFast: true,
+	}
+	c1, _ := p.Get()
+	c2, _ := p.Get()
+	if _, err := p.Get(); err != ErrPoolExhausted {
+		t.Fatalf("Expected ErrPoolExhausted, got %v", err)
+	}
+	p.Discard(c1)
+	c3, err := p.Get()
+	if err != nil {
+		t.Fatalf("Get after Discard failed: %s", err)
+	}
+
+	p.FailFast = false
+	got := make(chan *Client)
+	go func() {
+		c, _ := p.Get()
+		got <- c
+	}()
+	select {
+	case <-got:
+		t.Fatalf("Get should block while the limit is reached")
+	case <-time.After(20 * time.Millisecond):
+	}
+	p.Put(c2)
+	if c := <-got; c != c2 {
+		t.Fatalf("Expected blocked Get to receive the returned client")
+	}
+	p.Put(c3)
+}
+
+func TestPoolRetiresClosingClient(t *testing.T) {
+	var dials int
+	p := &Pool{New: func() (*Client, error) {
+		dials++
+		c, _ := newFakeClient("421 4.3.2 Service shutting down\n")
+		return c, nil
+	}}
+	c, _ := p.Get()
+	if err := c.Reset(); err == nil {
+		t.Fatalf("Expected RSET to fail")
+	}
+	if !c.Closing() {
+		t.Fatalf("Expected client to be marked as closing")
+	}
+	p.Put(c)
+	if c2, _ := p.Get(); c2 == c || dials != 2 {
+		t.Fatalf("Expected closing client to be retired")
+	}
+}
+
+func TestPoolDrainsPipelinedReplies(t *testing.T) {
+	p := &Pool{
+		New: func() (*Client, error) {
+			server := "220 hello world\r\n250 mx.example.com\r\n250 first\r\n250 second\r\n250 third\r\n"
+			var fake faker
+			fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bufio.NewWriter(io.Discard))
+			c, _, err := NewClient(fake, "fake.host")
+			return c, err
+		},
+	}
+	c, err := p.Get()
+	if err != nil {
+		t.Fatalf("Get failed: %s", err)
+	}
+	if _, err := c.pipeline([]string{"NOOP", "NOOP"}); err != nil {
+		t.Fatalf("pipeline failed: %s", err)
+	}
+	p.Put(c)
+	if c2, _ := p.Get(); c2 != c {
+		t.Fatalf("Expected drained client to be reused")
+	}
+	if _, msg, err := c.cmd(250, "NOOP"); err != nil || msg != "third" {
+		t.Fatalf("Got reply %q, %v, expected the third one", msg, err)
+	}
+}
+
+func TestPoolResetsOpenTransaction(t *testing.T) {
+	var c *Client
+	var out func() string
+	p := &Pool{New: func() (*Client, error) {
+		c, out = newFakeClient("250 Sender OK\n250 Reset\n")
+		return c, nil
+	}}
+	c, _ = p.Get()
+	if err := c.Mail("user@example.com"); err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+	p.Put(c)
+	if got, want := out(), "MAIL FROM:<user@example.com>\nRSET\n"; got != want {
+		t.Fatalf("Got %q, expected %q", got, want)
+	}
+	if c2, _ := p.Get(); c2 != c {
+		t.Fatalf("Expected reset client to be reused")
+	}
+}
+
+func TestPoolMaxIdle(t *testing.T) {
+	var dials int
+	p := &Pool{
+		New: func() (*Client, error) {
+			dials++
+			c, _ := newFakeClient("")
+			return c, nil
+		},
+		MaxIdle: time.Hour,
+	}
+	c, _ := p.Get()
+	p.Put(c)
+	if c2, _ := p.Get(); c2 != c {
+		t.Fatalf("Expected idle client to be reused")
+	}
+	p.Put(c)
+	p.idle[0].since = time.Now().Add(-2 * time.Hour)
+	if c2, _ := p.Get(); c2 == c || dials != 2 {
+		t.Fatalf("Expected client idle for too long to be closed")
+	}
+	if p.open != 1 {
+		t.Fatalf("Got %d open connections, expected 1", p.open)
+	}
+}
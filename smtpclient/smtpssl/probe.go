@@ -0,0 +1,102 @@
+//Copyright 2015 NF Design UG (haftungsbeschraenkt)
+//All right reserved.
+
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+
+//  http://www.apache.org/licenses/LICENSE-2.0
+
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package smtpssl
+
+// Checking the setup of a server without sending mail
+
+import (
+	"crypto/tls"
+	"net/textproto"
+)
+
+// ProbeOptions configures Probe.
+type ProbeOptions struct {
+	// Send configures the connection as for SendMailWithOptions. It may
+	// be nil.
+	Send *SendOptions
+	// RelayFrom and RelayTo, if RelayTo is set, enable the open relay
+	// test: Probe then issues MAIL FROM:<RelayFrom> and RCPT TO:<RelayTo>,
+	// where RelayTo should be in a domain the server is not responsible
+	// for, and aborts the transaction with RSET without sending data.
+	//
+	// Only run the test against servers you are authorized to test.
+	RelayFrom, RelayTo string
+}
+
+// ProbeResult describes the server found by Probe.
+type ProbeResult struct {
+	Greeting GreetingMode
+	// Extensions advertised in the EHLO reply, after STARTTLS if used.
+	Extensions map[string]string
+	// TLS is the state of the connection, nil if TLS was not used.
+	TLS *tls.ConnectionState
+	// RelayTested reports whether the open relay test was run.
+	RelayTested bool
+	// RelayAccepted reports whether the server accepted the external
+	// recipient without authentication, i.e. is an open relay.
+	RelayAccepted bool
+	// Relay is the reply to the RCPT command of the open relay test.
+	Relay RcptResult
+	// Transcript is the protocol log of the probe.
+	Transcript []byte
+}
+
+// Probe connects to the server at addr, switching to TLS as a send helper
+// would, reports what the server offers and quits without sending a
+// message. opts may be nil.
+func Probe(addr string, opts *ProbeOptions) (*ProbeResult, error) {
+	if opts == nil {
+		opts = &ProbeOptions{}
+	}
+	sendOpts := opts.Send
+	if sendOpts == nil {
+		sendOpts = &SendOptions{}
+	}
+	c, err := connect(addr, sendOpts)
+	if c == nil {
+		return nil, sendError(err)
+	}
+	res := &ProbeResult{Greeting: c.greeting, Extensions: c.ext}
+	if state, ok := c.TLSConnectionState(); ok {
+		res.TLS = &state
+	}
+
+	if err == nil && opts.RelayTo != "" {
+		err = c.probeRelay(opts.RelayFrom, opts.RelayTo, res)
+	}
+	if err != nil {
+		c.Close()
+	} else {
+		err = c.Quit()
+	}
+	res.Transcript = c.log.w.smtplog
+	return res, sendError(err)
+}
+
+// probeRelay runs the open relay test of Probe.
+func (c *Client) probeRelay(from, to string, res *ProbeResult) error {
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	res.RelayTested = true
+	code, msg, err := c.rcpt(to, nil)
+	res.Relay = newRcptResult(to, code, msg, err)
+	res.RelayAccepted = err == nil
+	if _, ok := err.(*textproto.Error); err != nil && !ok {
+		return err
+	}
+	return c.Reset()
+}
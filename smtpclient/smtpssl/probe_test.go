@@ -0,0 +1,53 @@
+//Copyright 2015 NF Design UG (haftungsbeschraenkt)
+//All right reserved.
+
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+
+//  http://www.apache.org/licenses/LICENSE-2.0
+
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package smtpssl
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProbeRelay(t *testing.T) {
+	tests := []struct {
+		reply    string
+		accepted bool
+	}{
+		{"250 2.1.5 Ok", true},
+		{"554 5.7.1 Relay access denied", false},
+	}
+	for _, tt := range tests {
+		server := "220 hello world\n250-mx.example.com\n250 SIZE 1000\n250 Sender OK\n" + tt.reply + "\n250 Reset OK\n221 Bye\n"
+		d := &fakeDialer{server: server}
+		opts := &ProbeOptions{
+			Send:      &SendOptions{ClientOptions: []Option{WithDialer(d)}},
+			RelayFrom: "probe@example.com",
+			RelayTo:   "victim@example.org",
+		}
+		res, err := Probe("mx.example.com:25", opts)
+		if err != nil {
+			t.Fatalf("%s: Probe: %v", tt.reply, err)
+		}
+		if !res.RelayTested || res.RelayAccepted != tt.accepted {
+			t.Errorf("%s: tested %v, accepted %v", tt.reply, res.RelayTested, res.RelayAccepted)
+		}
+		if res.Greeting != GreetingEHLO || res.Extensions["SIZE"] != "1000" {
+			t.Errorf("%s: greeting %v, extensions %v", tt.reply, res.Greeting, res.Extensions)
+		}
+		if !strings.Contains(string(res.Transcript), "C: RSET") || strings.Contains(string(res.Transcript), "C: DATA") {
+			t.Errorf("%s: transaction not aborted:\n%s", tt.reply, res.Transcript)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+//Copyright 2015 NF Design UG (haftungsbeschraenkt)
+//All right reserved.
+
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+
+//  http://www.apache.org/licenses/LICENSE-2.0
+
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package smtpssl
+
+// PROXY protocol header for servers behind load balancers
+// (http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt)
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ProxyHeader describes the PROXY protocol header sent to the server
+// before anything else, so it sees the given client address.
+type ProxyHeader struct {
+	// Version is 1 for the text or 2 for the binary format.
+	Version int
+	// Source and Destination default to the local and remote address of
+	// the connection. If the addresses are not TCP addresses of the same
+	// family, the header announces an unknown (v1) or local (v2)
+	// connection.
+	Source, Destination net.Addr
+}
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// WithProxyHeader makes the Client send h right after connecting, before
+// the TLS handshake of implicit TLS connections and the greeting.
+func WithProxyHeader(h *ProxyHeader) Option {
+	return func(c *Client) {
+		c.proxyHeader = h
+	}
+}
+
+// encode returns the header for a connection from src to dst.
+func (h *ProxyHeader) encode(src, dst net.Addr) ([]byte, error) {
+	if h.Source != nil {
+		src = h.Source
+	}
+	if h.Destination != nil {
+		dst = h.Destination
+	}
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	known := sok && dok && (s.IP.To4() == nil) == (d.IP.To4() == nil)
+	v4 := known && s.IP.To4() != nil
+
+	switch h.Version {
+	case 1:
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		proto := "TCP6"
+		if v4 {
+			proto = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, s.IP, d.IP, s.Port, d.Port)), nil
+	case 2:
+		var b bytes.Buffer
+		b.Write(proxyV2Signature)
+		if !known {
+			// LOCAL command, unspecified family, no addresses
+			b.Write([]byte{0x20, 0x00, 0x00, 0x00})
+			return b.Bytes(), nil
+		}
+		var fam byte = 0x21
+		srcIP, dstIP := s.IP.To16(), d.IP.To16()
+		if v4 {
+			fam = 0x11
+			srcIP, dstIP = s.IP.To4(), d.IP.To4()
+		}
+		// version 2, PROXY command; TCP over the address family
+		b.Write([]byte{0x21, fam})
+		binary.Write(&b, binary.BigEndian, uint16(2*len(srcIP)+4))
+		b.Write(srcIP)
+		b.Write(dstIP)
+		binary.Write(&b, binary.BigEndian, uint16(s.Port))
+		binary.Write(&b, binary.BigEndian, uint16(d.Port))
+		return b.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unsupported PROXY protocol version %d", h.Version)
+}
+
+// writeProxyHeader sends the configured PROXY protocol header on conn. For
+// TLS connections the header goes out on the underlying connection, which
+// is only possible before the handshake.
+func (c *Client) writeProxyHeader(conn net.Conn) error {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if tlsConn.ConnectionState().HandshakeComplete {
+			return errors.New("PROXY header must be sent before the TLS handshake")
+		}
+		conn = tlsConn.NetConn()
+	}
+	hdr, err := c.proxyHeader.encode(conn.LocalAddr(), conn.RemoteAddr())
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(hdr)
+	return err
+}
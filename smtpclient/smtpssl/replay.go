@@ -0,0 +1,79 @@
+//Copyright 2015 NF Design UG (haftungsbeschraenkt)
+//All right reserved.
+
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+
+//  http://www.apache.org/licenses/LICENSE-2.0
+
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package smtpssl
+
+// Replaying recorded sessions in tests
+
+import (
+	"bytes"
+	"net"
+	"time"
+)
+
+// ReplayScript extracts the server replies from a protocol log, such as
+// SendResult.Transcript, into a script for NewReplayConn. Replies
+// redacted during AUTH can not be recovered and have to be added to the
+// script by hand.
+func ReplayScript(transcript []byte) []byte {
+	var (
+		script []byte
+		server bool
+	)
+	for _, line := range bytes.SplitAfter(transcript, []byte("\n")) {
+		switch {
+		case bytes.Equal(line, []byte("S: Raw log disabled during AUTH\n")),
+			bytes.HasPrefix(line, []byte("Connected to: ")),
+			bytes.Equal(line, []byte(truncatedMarker)):
+			continue
+		case bytes.HasPrefix(line, []byte("S: ")):
+			server = true
+			line = line[3:]
+		case bytes.HasPrefix(line, []byte("C: ")):
+			server = false
+		}
+		if server {
+			script = append(script, line...)
+		}
+	}
+	return script
+}
+
+// ReplayConn is a net.Conn feeding canned server replies to a Client,
+// e.g. to replay a session recorded with ReplayScript deterministically
+// in tests. What the Client sends is recorded.
+type ReplayConn struct {
+	r    *bytes.Reader
+	sent bytes.Buffer
+}
+
+// NewReplayConn returns a connection reading script.
+func NewReplayConn(script []byte) *ReplayConn {
+	return &ReplayConn{r: bytes.NewReader(script)}
+}
+
+// Sent returns the data written by the Client so far.
+func (c *ReplayConn) Sent() []byte {
+	return c.sent.Bytes()
+}
+
+func (c *ReplayConn) Read(b []byte) (int, error)       { return c.r.Read(b) }
+func (c *ReplayConn) Write(b []byte) (int, error)      { return c.sent.Write(b) }
+func (c *ReplayConn) Close() error                     { return nil }
+func (c *ReplayConn) LocalAddr() net.Addr              { return nil }
+func (c *ReplayConn) RemoteAddr() net.Addr             { return nil }
+func (c *ReplayConn) SetDeadline(time.Time) error      { return nil }
+func (c *ReplayConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *ReplayConn) SetWriteDeadline(time.Time) error { return nil }
@@ -0,0 +1,58 @@
+//Copyright 2015 NF Design UG (haftungsbeschraenkt)
+//All right reserved.
+
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+
+//  http://www.apache.org/licenses/LICENSE-2.0
+
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package smtpssl
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReplay(t *testing.T) {
+	d := &fakeDialer{server: `220 hello world
+250-mx.example.com
+250 8BITMIME
+250 Sender OK
+250 Receiver OK
+354 Go ahead
+250 2.0.0 Ok: queued as 1A2B
+221 Bye
+`}
+	opts := &SendOptions{ClientOptions: []Option{WithDialer(d)}}
+	res, err := SendMailWithOptions("mx.example.com:25", nil, nil, "a@example.com", []string{"b@example.com"}, []byte("body\r\n"), opts)
+	if err != nil {
+		t.Fatalf("SendMailWithOptions: %v", err)
+	}
+
+	script := ReplayScript(res.Transcript)
+	if !strings.HasPrefix(string(script), "220 hello world\r\n") || strings.Contains(string(script), "C: ") {
+		t.Fatalf("Bad script:\n%s", script)
+	}
+	conn := NewReplayConn(script)
+	c, _, err := NewClient(conn, "mx.example.com")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if _, err := c.SendIfAccepted("a@example.com", []string{"b@example.com"}, strings.NewReader("body\r\n")); err != nil {
+		t.Fatalf("Replayed transaction: %v", err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatalf("Replayed QUIT: %v", err)
+	}
+	expected := "EHLO localhost\r\nMAIL FROM:<a@example.com> BODY=8BITMIME\r\nRCPT TO:<b@example.com>\r\nDATA\r\nbody\r\n.\r\nQUIT\r\n"
+	if sent := string(conn.Sent()); sent != expected {
+		t.Errorf("Sent %q, expected %q", sent, expected)
+	}
+}
@@ -0,0 +1,80 @@
+//Copyright 2015 NF Design UG (haftungsbeschraenkt)
+//All right reserved.
+
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+
+//  http://www.apache.org/licenses/LICENSE-2.0
+
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package smtpssl
+
+// Rewriting non-standard server replies
+
+import (
+	"bufio"
+	"net"
+	"strings"
+)
+
+// WithReplyFilter makes the Client pass every line the server sends,
+// without its line ending, through f before parsing it, so f can repair
+// replies of non-compliant servers, e.g. with LenientReply. The protocol
+// log records the lines as received.
+func WithReplyFilter(f func(line string) string) Option {
+	return func(c *Client) {
+		c.replyFilter = f
+	}
+}
+
+// LenientReply is a reply filter for WithReplyFilter removing leading
+// whitespace, which some appliances send before the reply code.
+func LenientReply(line string) string {
+	return strings.TrimLeft(line, " \t")
+}
+
+// replyFilterConn passes the complete lines read from the connection
+// through filter.
+type replyFilterConn struct {
+	net.Conn
+	r      *bufio.Reader
+	filter func(line string) string
+	// filtered data not read yet
+	buf []byte
+}
+
+func newReplyFilterConn(conn net.Conn, filter func(line string) string) *replyFilterConn {
+	return &replyFilterConn{Conn: conn, r: bufio.NewReader(conn), filter: filter}
+}
+
+// buffered returns the number of bytes read from the connection, but not
+// yet by the Client.
+func (f *replyFilterConn) buffered() int {
+	return len(f.buf) + f.r.Buffered()
+}
+
+func (f *replyFilterConn) Read(b []byte) (int, error) {
+	if len(f.buf) == 0 {
+		line, err := f.r.ReadString('\n')
+		if line == "" {
+			return 0, err
+		}
+		if body, ok := strings.CutSuffix(line, "\n"); ok {
+			eol := "\n"
+			if body, ok = strings.CutSuffix(body, "\r"); ok {
+				eol = "\r\n"
+			}
+			line = f.filter(body) + eol
+		}
+		f.buf = []byte(line)
+	}
+	n := copy(b, f.buf)
+	f.buf = f.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,50 @@
+//Copyright 2015 NF Design UG (haftungsbeschraenkt)
+//All right reserved.
+
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+
+//  http://www.apache.org/licenses/LICENSE-2.0
+
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package smtpssl
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReplyFilter(t *testing.T) {
+	server := strings.Join(strings.Split(" 220 hello world\n  250-mx.example.com\n\t250 SIZE 1000\n2500 Sender OK\n", "\n"), "\r\n")
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bufio.NewWriter(io.Discard))
+	fourDigits := func(line string) string {
+		line = LenientReply(line)
+		if len(line) > 4 && line[3] == '0' && line[4] == ' ' {
+			return line[:3] + line[4:]
+		}
+		return line
+	}
+	c, bytelog, err := NewClient(fake, "fake.host", WithReplyFilter(fourDigits))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if ok, size := c.Extension("SIZE"); !ok || size != "1000" {
+		t.Errorf("Got SIZE %v %q", ok, size)
+	}
+	if err := c.Mail("a@example.com"); err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+	if !bytes.Contains(bytelog.smtplog, []byte("2500 Sender OK")) {
+		t.Errorf("Expected the log to record the reply as received:\n%s", bytelog.smtplog)
+	}
+}
@@ -0,0 +1,285 @@
+//Copyright 2015 NF Design UG (haftungsbeschraenkt)
+//All right reserved.
+
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+
+//  http://www.apache.org/licenses/LICENSE-2.0
+
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package smtpssl
+
+// Structured results of the send helpers
+
+import (
+	"crypto/tls"
+	"errors"
+	"strings"
+	"time"
+)
+
+// SendOptions controls the sessions run by SendMailWithOptions.
+type SendOptions struct {
+	// SSL connects over an explicit TLS channel instead of trying STARTTLS.
+	SSL bool
+	// ClientOptions configure the Client, e.g. WithNetwork("tcp4") to pin
+	// the address family used for the destination.
+	ClientOptions []Option
+	// PlaintextFallback makes the session continue without TLS on a new
+	// connection if the server advertises STARTTLS but refuses the
+	// command. Failed TLS handshakes still abort the session.
+	PlaintextFallback bool
+	// RequireAuth makes the session fail with ErrAuthRequired before
+	// MAIL if the server advertises AUTH but no credentials were given,
+	// instead of trying to send unauthenticated as needed for delivery
+	// to MX hosts.
+	RequireAuth bool
+	// Notify requests delivery status notifications for the given
+	// conditions for every recipient, see RcptOptions.
+	Notify []string
+	// Return and EnvID are sent with MAIL to control the notifications,
+	// see MailOptions.
+	Return string
+	EnvID  string
+	// TLSConfig is used for STARTTLS, or the TLS channel with SSL,
+	// instead of a configuration only setting the server name, which is
+	// filled in if empty.
+	TLSConfig *tls.Config
+	// RequireTLS makes the session fail with ErrTLSRequired if the server
+	// does not offer STARTTLS, and disables PlaintextFallback.
+	RequireTLS bool
+	// TLSPolicy is consulted by SendMailMX for each recipient domain.
+	TLSPolicy TLSPolicyLookup
+	// MaxConns is the number of connections SendBatch uses in parallel.
+	// Zero means DefaultBatchConns.
+	MaxConns int
+	// ConnDialer, if set, returns the Dialer for each connection
+	// SendBatch opens, numbered from zero, e.g. a *net.Dialer with a
+	// LocalAddr chosen to rotate source IPs for reputation management.
+	// It overrides a dialer set in ClientOptions.
+	ConnDialer func(n int) Dialer
+	// AllowPartial makes the session go on with the remaining
+	// recipients if the server rejects some of them, and deliver the
+	// message to those accepted. Only if it rejects all of them, the
+	// session fails with ErrRecipientRejected.
+	AllowPartial bool
+	// SpoolMemory is the number of bytes SendMailReader buffers in memory
+	// before spilling to a temporary file. Zero means DefaultSpoolMemory.
+	SpoolMemory int64
+}
+
+// Phases of a session timed in SendResult.PhaseTimings.
+const (
+	PhaseConnect  = "connect"
+	PhaseGreeting = "greeting"
+	// PhaseEHLO includes the HELO fallback and the EHLO after STARTTLS.
+	PhaseEHLO = "EHLO"
+	// PhaseSTARTTLS is the STARTTLS command and the TLS handshake, or the
+	// handshake of an implicit TLS connection.
+	PhaseSTARTTLS = "STARTTLS"
+	PhaseAuth     = "AUTH"
+	PhaseMail     = "MAIL"
+	// PhaseRcpt is the total of all RCPT commands. The send helpers count
+	// them as PhaseMail when they are pipelined with MAIL.
+	PhaseRcpt = "RCPT"
+	// PhaseData is the DATA command, the message transfer and the reply.
+	PhaseData = "DATA"
+)
+
+// SendResult describes the outcome of a session run by one of the send
+// helpers.
+type SendResult struct {
+	// Transcript is the protocol log of the session.
+	Transcript []byte
+	// Recipients holds the outcome of each RCPT command issued.
+	Recipients []RcptResult
+	// Accepted is set once the server accepted the message data. An
+	// error returned along with it occurred later, e.g. with QUIT, so
+	// sending again would deliver the message twice.
+	Accepted bool
+	// QueueID is the identifier the server assigned to the accepted
+	// message, if its reply contained one.
+	QueueID string
+	// TLS is the state of the connection, nil if TLS was not used.
+	TLS *tls.ConnectionState
+	// MailParams are the parameters sent with the MAIL command, e.g.
+	// "BODY=8BITMIME" and "SIZE=1024", as decided from the extensions
+	// the server advertised.
+	MailParams []string
+	// AuthMechanism is the SASL mechanism used to authenticate, if any.
+	AuthMechanism string
+	// AuthDecisions tells for each mechanism the server advertised why it
+	// was or was not chosen, in the order of the advertisement.
+	AuthDecisions []AuthDecision
+	// BytesSent is the number of bytes written to the connection,
+	// protocol overhead included.
+	BytesSent int64
+	// Elapsed is the wall-clock duration of the session.
+	Elapsed time.Duration
+	// PhaseTimings holds the time spent in each phase of the session,
+	// keyed by the Phase constants. Phases not reached are missing.
+	PhaseTimings map[string]time.Duration
+	// Err is the error of the message sent by SendBatch, which returns
+	// no separate errors. The other helpers leave it nil.
+	Err error
+}
+
+// AuthDecision records why the send helpers chose or skipped an
+// advertised authentication mechanism.
+type AuthDecision struct {
+	Mechanism string
+	Reason    AuthReason
+}
+
+// AuthReason is the reason for an AuthDecision.
+type AuthReason string
+
+const (
+	// AuthSelected marks the mechanism used, or attempted if AUTH failed.
+	AuthSelected AuthReason = "selected"
+	// AuthSkippedWeaker marks the mechanisms left to aplain when
+	// CRAM-MD5 was used instead.
+	AuthSkippedWeaker AuthReason = "skipped-weaker"
+	// AuthSkippedNoCredentials marks a mechanism no Auth was given for.
+	AuthSkippedNoCredentials AuthReason = "skipped-no-creds"
+	// AuthSkippedInsecure marks the mechanism of the Auth that refused to
+	// send its credentials on a connection without TLS, failing the
+	// session with ErrInsecureAuth.
+	AuthSkippedInsecure AuthReason = "skipped-insecure"
+	// AuthSkippedUnsupported marks a mechanism the given Auth does not
+	// implement.
+	AuthSkippedUnsupported AuthReason = "skipped-unsupported"
+)
+
+// authDecisions explains the choice of the send helpers among the
+// mechanisms advertised by the server. tried is the mechanism started by
+// the Auth they chose, which failed with err, and usedCRAM tells whether
+// that was acram. havePlain and haveCRAM tell whether aplain and acram
+// were given.
+func authDecisions(advertised []string, tried string, err error, havePlain, haveCRAM, usedCRAM bool) []AuthDecision {
+	var decisions []AuthDecision
+	for _, mech := range advertised {
+		d := AuthDecision{Mechanism: mech, Reason: AuthSkippedUnsupported}
+		switch {
+		case mech == tried && errors.Is(err, ErrInsecureAuth):
+			d.Reason = AuthSkippedInsecure
+		case mech == tried:
+			d.Reason = AuthSelected
+		case mech == "CRAM-MD5" && !haveCRAM, mech != "CRAM-MD5" && !havePlain:
+			d.Reason = AuthSkippedNoCredentials
+		case usedCRAM:
+			d.Reason = AuthSkippedWeaker
+		}
+		decisions = append(decisions, d)
+	}
+	return decisions
+}
+
+// RcptResult is the outcome of a single RCPT command.
+type RcptResult struct {
+	Addr string
+	// Code and Msg hold the server's reply, Code is 0 if none was read.
+	Code int
+	Msg  string
+	// EnhancedCode is the enhanced status code (RFC 3463) the reply
+	// started with, e.g. "5.1.1", or "" if there was none.
+	EnhancedCode string
+	// Class tells whether a rejection is permanent or transient, e.g. to
+	// decide whether the address belongs on a suppression list.
+	Class Class
+	// Err is non-nil if the recipient was not accepted.
+	Err error
+}
+
+func newRcptResult(addr string, code int, msg string, err error) RcptResult {
+	r := RcptResult{Addr: addr, Code: code, Msg: msg, EnhancedCode: enhancedCode(msg), Err: err}
+	if err != nil {
+		r.Class = classify(code, r.EnhancedCode)
+	}
+	return r
+}
+
+// Class classifies a failure reported by the server.
+type Class int
+
+const (
+	// ClassUnknown is used if there was no failure or no reply to
+	// classify it by, e.g. after a network error.
+	ClassUnknown Class = iota
+	// ClassTransient failures (4xx, e.g. 4.2.1 mailbox busy) may succeed
+	// when retried later.
+	ClassTransient
+	// ClassPermanent failures (5xx, e.g. 5.1.1 bad mailbox) will not
+	// succeed when retried.
+	ClassPermanent
+)
+
+func (c Class) String() string {
+	switch c {
+	case ClassTransient:
+		return "transient"
+	case ClassPermanent:
+		return "permanent"
+	}
+	return "unknown"
+}
+
+// classify derives the Class of a failure from the enhanced status code,
+// or the basic reply code if there is none.
+func classify(code int, enhanced string) Class {
+	class := code / 100
+	if enhanced != "" {
+		class = int(enhanced[0] - '0')
+	}
+	switch class {
+	case 4:
+		return ClassTransient
+	case 5:
+		return ClassPermanent
+	}
+	return ClassUnknown
+}
+
+// queueID extracts the queue identifier from the reply to the message
+// data, as sent by Postfix ("2.0.0 Ok: queued as 4F3C21E1A3") or Exim
+// ("OK id=1aBcDe-0001Xy-Ab").
+func queueID(msg string) string {
+	for _, marker := range []string{"queued as ", "id="} {
+		if i := strings.Index(msg, marker); i >= 0 {
+			if f := strings.Fields(msg[i+len(marker):]); len(f) > 0 {
+				return f[0]
+			}
+		}
+	}
+	return ""
+}
+
+// enhancedCode returns the enhanced status code (RFC 3463) a reply text
+// starts with, e.g. "5.1.1", or "" if there is none.
+func enhancedCode(msg string) string {
+	code := msg
+	if i := strings.IndexAny(code, " \n"); i >= 0 {
+		code = code[:i]
+	}
+	parts := strings.Split(code, ".")
+	if len(parts) != 3 || len(parts[0]) != 1 || !strings.Contains("245", parts[0]) {
+		return ""
+	}
+	for _, p := range parts[1:] {
+		if len(p) < 1 || len(p) > 3 {
+			return ""
+		}
+		for i := 0; i < len(p); i++ {
+			if p[i] < '0' || p[i] > '9' {
+				return ""
+			}
+		}
+	}
+	return code
+}
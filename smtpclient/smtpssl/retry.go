@@ -0,0 +1,69 @@
+//Copyright 2015 NF Design UG (haftungsbeschraenkt)
+//All right reserved.
+
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+
+//  http://www.apache.org/licenses/LICENSE-2.0
+
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package smtpssl
+
+// Retrying sessions after transient failures
+
+import (
+	"errors"
+	"time"
+)
+
+// RetryPolicy tells SendMailRetry how often to run a session again after
+// a transient failure and how long to wait in between.
+type RetryPolicy struct {
+	// MaxAttempts is the number of sessions run at most, the first one
+	// included. Values below 1 mean 1.
+	MaxAttempts int
+	// Backoff returns the delay before the next attempt after the given
+	// number of failed attempts, e.g. ExponentialBackoff. If nil, the
+	// next attempt starts right away.
+	Backoff ReconnectStrategy
+}
+
+// sleep is replaced by tests.
+var sleep = time.Sleep
+
+// SendMailRetry is like SendMailWithOptions, but runs the session again
+// on a new connection, as policy allows, if it failed transiently: with
+// a 4xx reply, e.g. 451 from a greylisting server or 421 when the server
+// closes the connection, or with an error wrapping ErrNetwork. 5xx
+// replies are permanent and returned right away. The result and error of
+// the last attempt are returned.
+//
+// A message may be delivered twice if the connection is lost after the
+// message data was sent but before the server's reply was read.
+func SendMailRetry(addr string, aplain Auth, acram Auth, from string, to []string, msg []byte, opts *SendOptions, policy RetryPolicy) (*SendResult, error) {
+	for attempt := 1; ; attempt++ {
+		res, err := SendMailWithOptions(addr, aplain, acram, from, to, msg, opts)
+		if err == nil || attempt >= policy.MaxAttempts || !transient(err) {
+			return res, err
+		}
+		if policy.Backoff != nil {
+			sleep(policy.Backoff.Delay(attempt))
+		}
+	}
+}
+
+// transient reports whether err, returned by a send helper, may go away
+// when the session is run again.
+func transient(err error) bool {
+	var serr *SMTPError
+	if errors.As(err, &serr) {
+		return serr.Temporary()
+	}
+	return errors.Is(err, ErrNetwork)
+}
@@ -0,0 +1,61 @@
+//Copyright 2015 NF Design UG (haftungsbeschraenkt)
+//All right reserved.
+
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+
+//  http://www.apache.org/licenses/LICENSE-2.0
+
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package smtpssl
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func stubSleep(t *testing.T) *[]time.Duration {
+	var slept []time.Duration
+	orig := sleep
+	sleep = func(d time.Duration) { slept = append(slept, d) }
+	t.Cleanup(func() { sleep = orig })
+	return &slept
+}
+
+func TestSendMailRetry(t *testing.T) {
+	greylisted := "220 hello world\n250 mx.example.com\n250 Sender OK\n451 4.7.1 Greylisted, try again later\n250 Reset\n221 Bye\n"
+	shutdown := "421 4.3.2 Service shutting down\n"
+	dropped := "220 hello world\n250 mx.example.com\n"
+	accepting := "220 hello world\n250 mx.example.com\n250 Sender OK\n250 Receiver OK\n354 Go ahead\n250 Data OK\n221 Bye\n"
+	rejecting := "220 hello world\n250 mx.example.com\n550 5.7.1 Sender rejected\n221 Bye\n"
+	policy := RetryPolicy{MaxAttempts: 4, Backoff: ExponentialBackoff{time.Minute, time.Hour}}
+
+	for _, tt := range []struct {
+		servers []string
+		ok      bool
+		slept   []time.Duration
+	}{
+		{[]string{greylisted, shutdown, accepting}, true, []time.Duration{time.Minute, 2 * time.Minute}},
+		{[]string{greylisted, rejecting, accepting}, false, []time.Duration{time.Minute}},
+		{[]string{greylisted, greylisted, greylisted, greylisted, accepting}, false, []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute}},
+		{[]string{dropped, accepting}, true, []time.Duration{time.Minute}},
+	} {
+		slept := stubSleep(t)
+		d := &seqDialer{servers: tt.servers}
+		opts := &SendOptions{ClientOptions: []Option{WithDialer(d)}}
+		_, err := SendMailRetry("mx.example.com:25", nil, nil, "a@example.com", []string{"b@example.com"}, []byte("body\r\n"), opts, policy)
+		if (err == nil) != tt.ok {
+			t.Errorf("%d servers: got %v", len(tt.servers), err)
+		}
+		if !reflect.DeepEqual(*slept, tt.slept) {
+			t.Errorf("%d servers: slept %v, expected %v", len(tt.servers), *slept, tt.slept)
+		}
+	}
+}
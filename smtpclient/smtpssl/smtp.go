@@ -44,69 +44,184 @@
 package smtpssl
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/textproto"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 //ByteLogger is a simple struct holding the smtp protocol log in smtplog []byte.
 type ByteLogger struct {
 	smtplog []byte
+	// MaxBytes, if positive, caps the size of the log, not counting the
+	// truncation marker. The oldest lines are dropped to make room.
+	MaxBytes int
+	// MaxLines, if positive, keeps only the last MaxLines lines.
+	MaxLines int
+	// RotateSize, if positive, makes the log pass its content to Rotate
+	// and start over once it has grown to RotateSize bytes, so a long
+	// session can be drained to a file in chunks. The transcript then
+	// only holds the data since the last rotation.
+	RotateSize int
+	// Rotate receives the rotated chunks, which it may retain.
+	Rotate func(chunk []byte)
+	// Output, if set, receives the log as it is written instead of the
+	// buffer, e.g. a log file, so nothing is held in memory. The
+	// transcript then stays empty and the limits do not apply.
+	Output io.Writer
+	// whether the log starts with truncatedMarker
+	truncated bool
 }
 
+// truncatedMarker starts a log after older lines were dropped.
+const truncatedMarker = "[truncated]\n"
+
 func (w *ByteLogger) Write(p []byte) (int, error) {
 
 	//This is in conscious violation of the type Writer spec in pkg/io:
 	//"Implementations must not retain p."
 
+	if w.Output != nil {
+		return w.Output.Write(p)
+	}
 	w.smtplog = append(w.smtplog, p...)
+	if w.RotateSize > 0 && w.Rotate != nil && len(w.smtplog) >= w.RotateSize {
+		w.Rotate(w.smtplog)
+		w.smtplog, w.truncated = nil, false
+	}
+	if w.MaxBytes > 0 || w.MaxLines > 0 {
+		w.trim()
+	}
 	return len(p), nil
 }
 
+// trim drops the oldest lines exceeding MaxLines or MaxBytes.
+func (w *ByteLogger) trim() {
+	log := w.smtplog
+	if w.truncated {
+		log = log[len(truncatedMarker):]
+	}
+	cut := 0
+	if n := bytes.Count(log, []byte("\n")); w.MaxLines > 0 && n > w.MaxLines {
+		for i := 0; i < n-w.MaxLines; i++ {
+			cut += bytes.IndexByte(log[cut:], '\n') + 1
+		}
+	}
+	if w.MaxBytes > 0 && len(log)-cut > w.MaxBytes {
+		cut = len(log) - w.MaxBytes
+		// keep whole lines if possible
+		if i := bytes.IndexByte(log[cut:], '\n'); i >= 0 && cut+i+1 < len(log) {
+			cut += i + 1
+		}
+	}
+	if cut > 0 {
+		w.smtplog = append([]byte(truncatedMarker), log[cut:]...)
+		w.truncated = true
+	}
+}
+
 type logProxy struct {
 	net.Conn
 	authInProgress bool
 	w              *ByteLogger
+	// log the AUTH exchange as well
+	unsafeAuth bool
+	// bytes written to the connection
+	written int64
+	// incomplete lines read and written, logged once complete
+	readBuf, writeBuf []byte
 }
 
 func (l *logProxy) Read(b []byte) (n int, err error) {
 	n, err = l.Conn.Read(b)
-
-	if strings.HasPrefix(string(b[:n]), "235") || strings.HasPrefix(string(b[:n]), "535") {
-		l.authInProgress = false
-	}
-
-	if !l.authInProgress {
-
-		l.w.Write(append([]byte("S: "), b[:n]...))
-	} else {
-
-		l.w.Write([]byte("S: Raw log disabled during AUTH\n"))
-	}
-
+	l.readBuf = l.logLines("S: ", append(l.readBuf, b[:n]...))
 	return
 }
 
 func (l *logProxy) Write(b []byte) (n int, err error) {
 
 	n, err = l.Conn.Write(b)
+	l.written += int64(n)
+	l.writeBuf = l.logLines("C: ", append(l.writeBuf, b[:n]...))
+	return
+}
 
-	if strings.HasPrefix(string(b[:n]), "AUTH") {
-		l.authInProgress = true
-	}
+// logLines logs each complete line in data with prefix, so lines split
+// across reads or writes are not garbled, and returns the rest.
+func (l *logProxy) logLines(prefix string, data []byte) []byte {
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			return data
+		}
+		line := data[:i+1]
+		data = data[i+1:]
 
-	if !l.authInProgress {
+		if prefix == "C: " && isAuthCommand(line) {
+			l.authInProgress = true
+		}
+		// only challenges and responses carry credentials
+		final := prefix == "S: " && isFinalReply(line)
+		if !l.authInProgress || l.unsafeAuth || final {
+			l.w.Write(append([]byte(prefix), line...))
+		} else {
+			l.w.Write([]byte(prefix + "Raw log disabled during AUTH\n"))
+		}
+		if final && isLastLine(line) {
+			// the AUTH command completed, whatever its outcome
+			l.authInProgress = false
+		}
+	}
+}
 
-		l.w.Write(append([]byte("C: "), b[:n]...))
-	} else {
+// isAuthCommand reports whether line is an AUTH command.
+func isAuthCommand(line []byte) bool {
+	return len(line) > 4 && bytes.EqualFold(line[:5], []byte("AUTH "))
+}
 
-		l.w.Write([]byte("S: Raw log disabled during AUTH\n"))
+// isFinalReply reports whether line belongs to a reply completing a
+// command, as opposed to a 334 AUTH challenge, which carries
+// mechanism data.
+func isFinalReply(line []byte) bool {
+	if len(line) < 3 || bytes.HasPrefix(line, []byte("334")) {
+		return false
+	}
+	for _, b := range line[:3] {
+		if b < '0' || b > '9' {
+			return false
+		}
 	}
+	return true
+}
 
-	return
+// isLastLine reports whether line is the last one of a reply, not
+// followed by more lines as announced by a hyphen after the code.
+func isLastLine(line []byte) bool {
+	return len(line) < 4 || line[3] != '-'
+}
+
+// Close logs incomplete lines and closes the connection.
+func (l *logProxy) Close() error {
+	for _, p := range []struct {
+		prefix string
+		buf    *[]byte
+	}{{"S: ", &l.readBuf}, {"C: ", &l.writeBuf}} {
+		if len(*p.buf) > 0 {
+			l.logLines(p.prefix, append(*p.buf, '\n'))
+			*p.buf = nil
+		}
+	}
+	return l.Conn.Close()
 }
 
 // A Client represents a client connection to an SMTP server.
@@ -117,6 +232,8 @@ type Client struct {
 	// keep a reference to the connection so it can be used to create a TLS
 	// connection later
 	conn net.Conn
+	// the protocol logging wrapper of conn
+	log *logProxy
 	// whether the Client is using TLS
 	tls        bool
 	serverName string
@@ -124,58 +241,338 @@ type Client struct {
 	ext map[string]string
 	// supported auth mechanisms
 	auth []string
+	// mechanism used by the last successful Auth
+	authMech string
+	// mechanism of the last Auth, also if it failed, "" if Start did not
+	// name one
+	authTried string
+	// whether the server announced to close the connection
+	closing bool
+	// whether Quit or Close closed the connection
+	closed bool
+	// how the server was greeted
+	greeting GreetingMode
+	// text of the server's 220 greeting
+	banner string
+	// whether MAIL succeeded and the transaction was not completed or
+	// reset yet
+	inTransaction bool
+	// whether the last MAIL command requested SMTPUTF8
+	utf8 bool
+	// textproto ids of pipelined commands whose replies were not read
+	pendingIDs []uint
+	// parameters of the last MAIL command sent
+	mailParams []string
+	// time spent per phase, see PhaseTimings
+	phases map[string]time.Duration
+	// terminate lines with LF instead of CRLF
+	bareLF bool
+	// used by Dial to connect
+	dialer  Dialer
+	network string
+	// limits the wait for the greeting, including the TLS handshake
+	greetingTimeout time.Duration
+	// sent before the greeting, if set
+	proxyHeader *ProxyHeader
+	// limits and rotation of the protocol log, see ByteLogger
+	logMaxBytes, logMaxLines int
+	logRotateSize            int
+	logRotate                func(chunk []byte)
+	logOutput                io.Writer
+	// only convert bare LF to CRLF in the message header
+	headerOnlyCRLF bool
+	// rewrites the lines received, see WithReplyFilter
+	replyFilter func(line string) string
+	// applies replyFilter to the current connection
+	filterConn *replyFilterConn
+	// bounds blocking operations, see SetContext
+	ctx       context.Context
+	stopWatch func() bool
+
+	// RequireTLSForData makes Data refuse to send the message body over a
+	// connection that is not using TLS.
+	RequireTLSForData bool
+	// OnTLSHandshake, if set, is called with the connection state after
+	// each completed TLS handshake, both for implicit TLS and StartTLS,
+	// e.g. to log the SPKI hashes of the peer certificates. Use the
+	// WithOnTLSHandshake option to observe implicit TLS connections.
+	OnTLSHandshake func(state tls.ConnectionState)
+	// MaxAuthChallenges limits the number of challenges the server may
+	// send during Auth before it is aborted with ErrTooManyAuthChallenges.
+	// Zero means a default of 10.
+	MaxAuthChallenges int
+	// UnsafeLogAuthCredentials disables the redaction of the AUTH
+	// exchange in the protocol log, which then contains the credentials
+	// or data derived from them. Only meant for debugging against test
+	// servers, never enable it in production.
+	UnsafeLogAuthCredentials bool
+	// AsyncQuit makes Quit close the connection right after writing QUIT
+	// instead of waiting for the server's reply, saving a round-trip.
+	AsyncQuit bool
+	// CommandHook, if set, is called with the verb and the arguments of
+	// each command line before it is sent, e.g. "MAIL" and
+	// "FROM:<a@example.com>". It may return a rewritten line, which is
+	// sent instead, or an error to abort the command. Lines of an AUTH
+	// exchange other than the AUTH command itself are passed as the verb.
+	// QUIT is always sent unchanged.
+	CommandHook func(verb, args string) (string, error)
+	// SourceRoutes controls how Rcpt handles source-routed addresses.
+	SourceRoutes SourceRoutePolicy
+	// AutoReset makes Mail issue RSET first if a transaction is still
+	// open, instead of returning ErrTransactionAlreadyOpen.
+	AutoReset bool
+	// AddressSyntax controls how Mail and Rcpt write the addresses, the
+	// RFC 5321 form "<user@example.com>" by default.
+	AddressSyntax AddressSyntax
+	// LocalName is the host name announced with EHLO and HELO,
+	// "localhost" if empty. Many servers distrust clients announcing
+	// "localhost", so set it to the public host name of the client.
+	LocalName string
+	// StrictEHLO makes a rejected EHLO fail the greeting instead of
+	// falling back to HELO, which leaves no extensions known and so
+	// silently disables STARTTLS and AUTH.
+	StrictEHLO bool
+	// ReEHLODelay, if positive, makes the Client retry the EHLO after
+	// STARTTLS once after this delay if the server rejected it with a
+	// transient error.
+	ReEHLODelay time.Duration
+	// DataTee, if set, receives a copy of the message data exactly as
+	// Data sends it, after dot-stuffing and including the terminating
+	// ".", e.g. to archive the transmitted bytes for dispute resolution.
+	DataTee io.Writer
 }
 
+const defaultMaxAuthChallenges = 10
+
 // Dial returns a new Client connected to an SMTP server at addr.
-func Dial(addr string) (*Client, *ByteLogger, error) {
-	conn, err := net.Dial("tcp", addr)
+func Dial(addr string, opts ...Option) (*Client, *ByteLogger, error) {
+	c := newClient(opts)
+	conn, err := c.dial(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	host := hostOf(addr)
+
+	return c.start(conn, host)
+}
+
+// DialTimeout is like Dial, but gives up connecting after timeout, and
+// again if the server does not greet within timeout once connected, e.g.
+// when trying many MX hosts. A Dialer or greeting timeout given in opts
+// takes precedence.
+func DialTimeout(addr string, timeout time.Duration, opts ...Option) (*Client, *ByteLogger, error) {
+	opts = append([]Option{WithDialer(&net.Dialer{Timeout: timeout}), WithGreetingTimeout(timeout)}, opts...)
+	return Dial(addr, opts...)
+}
+
+// DialFrom is like Dial, but connects from the local IP address
+// localAddr, optionally with a port, e.g. to pick the source address,
+// and with it the sending reputation, on a host with several. It
+// replaces a Dialer given in opts.
+func DialFrom(localAddr, addr string, opts ...Option) (*Client, *ByteLogger, error) {
+	laddr, err := localTCPAddr(localAddr)
 	if err != nil {
 		return nil, nil, err
 	}
-	host := addr[:strings.Index(addr, ":")]
+	return DialProxy(addr, &net.Dialer{LocalAddr: laddr}, opts...)
+}
+
+// localTCPAddr parses addr, an IP address with or without a port.
+func localTCPAddr(addr string) (*net.TCPAddr, error) {
+	if ip := net.ParseIP(addr); ip != nil {
+		return &net.TCPAddr{IP: ip}, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid local address %q", addr)
+	}
+	ip := net.ParseIP(host)
+	n, err := strconv.Atoi(port)
+	if ip == nil || err != nil || n < 0 || n > 65535 {
+		return nil, fmt.Errorf("invalid local address %q", addr)
+	}
+	return &net.TCPAddr{IP: ip, Port: n}, nil
+}
 
-	return NewClient(conn, host)
+// DialProxy is like Dial, but connects through proxy, e.g. a SOCKS5
+// dialer from golang.org/x/net/proxy, which is passed addr unresolved.
+// The server name is still taken from addr. proxy takes precedence over
+// a Dialer given in opts.
+func DialProxy(addr string, proxy Dialer, opts ...Option) (*Client, *ByteLogger, error) {
+	opts = append(append([]Option(nil), opts...), WithDialer(proxy))
+	return Dial(addr, opts...)
+}
+
+// hostOf returns the host part of addr, used as server name, without
+// the brackets of an IPv6 literal such as "[2001:db8::1]:465". Addresses
+// without a port, as used by some non-TCP Dialers, are returned as is.
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
 }
 
 // NewClient returns a new Client using an existing connection and host as a
 // server name to be used when authenticating.
-func NewClient(conn net.Conn, host string) (*Client, *ByteLogger, error) {
+func NewClient(conn net.Conn, host string, opts ...Option) (*Client, *ByteLogger, error) {
+	return newClient(opts).start(conn, host)
+}
+
+// newClient returns a Client configured by opts, not yet connected.
+func newClient(opts []Option) *Client {
+	c := &Client{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// dial connects to addr using the configured Dialer and network.
+func (c *Client) dial(addr string) (net.Conn, error) {
+	d := c.dialer
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	network := c.network
+	if network == "" {
+		network = "tcp"
+	}
+	defer c.addPhase(PhaseConnect, time.Now())
+	if cd, ok := d.(interface {
+		DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+	}); ok && c.ctx != nil {
+		return cd.DialContext(c.ctx, network, addr)
+	}
+	return d.Dial(network, addr)
+}
+
+// addPhase adds the time passed since start to the timing of phase.
+func (c *Client) addPhase(phase string, start time.Time) {
+	if c.phases == nil {
+		c.phases = make(map[string]time.Duration)
+	}
+	c.phases[phase] += time.Since(start)
+}
+
+// PhaseTimings returns the time the Client spent in each phase of the
+// session so far, keyed by the Phase constants, e.g. to find out whether
+// AUTH or DATA dominates with a slow server.
+func (c *Client) PhaseTimings() map[string]time.Duration {
+	timings := make(map[string]time.Duration, len(c.phases))
+	for phase, d := range c.phases {
+		timings[phase] = d
+	}
+	return timings
+}
+
+// start reads the greeting from the server on conn and greets it.
+func (c *Client) start(conn net.Conn, host string) (_ *Client, _ *ByteLogger, err error) {
+
+	c.serverName = host
+
+	if c.ctx != nil {
+		c.watch(conn)
+		defer func() {
+			// the context may outlive the failed connection by far
+			if err != nil {
+				c.unwatch()
+			}
+		}()
+	}
+	if c.greetingTimeout > 0 {
+		d := time.Now().Add(c.greetingTimeout)
+		if ctxDeadline := c.deadline(); !ctxDeadline.IsZero() && ctxDeadline.Before(d) {
+			d = ctxDeadline
+		}
+		conn.SetDeadline(d)
+	}
 
-	var tlsactive = false
-	if _, ok := conn.(*tls.Conn); ok {
-		tlsactive = true
+	if c.proxyHeader != nil {
+		if err := c.writeProxyHeader(conn); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		start := time.Now()
+		if err := c.handshake(tlsConn); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		c.addPhase(PhaseSTARTTLS, start)
+		c.tls = true
 	}
 
-	w := &ByteLogger{}
+	w := &ByteLogger{MaxBytes: c.logMaxBytes, MaxLines: c.logMaxLines, RotateSize: c.logRotateSize, Rotate: c.logRotate, Output: c.logOutput}
 
 	if conn.RemoteAddr() != nil {
 		w.Write([]byte("Connected to: " + conn.RemoteAddr().String() + "\n"))
 	}
-	conn = &logProxy{conn, false, w}
+	c.log = &logProxy{Conn: conn, w: w}
+	c.conn = c.log
 
-	text := textproto.NewConn(conn)
-	_, _, err := text.ReadResponse(220)
+	c.Text = c.newText(c.conn)
+	start := time.Now()
+	_, banner, err := c.Text.ReadResponse(220)
 	if err != nil {
-		text.Close()
+		c.Text.Close()
 		return nil, nil, err
 	}
-
-	c := &Client{Text: text, conn: conn, serverName: host, tls: tlsactive}
+	c.addPhase(PhaseGreeting, start)
+	c.banner = banner
+	if c.greetingTimeout > 0 {
+		conn.SetDeadline(c.deadline())
+	}
 
 	err = c.ehlo()
-	if err != nil {
+	if err != nil && !c.StrictEHLO {
 		err = c.helo()
+	}
+	if err != nil {
+		c.Text.Close()
+		return nil, nil, err
+	}
+	return c, w, nil
+}
 
-		if err != nil {
-			return nil, nil, err
-		}
-
+// newText returns the textproto.Conn used to talk to the server over conn.
+func (c *Client) newText(conn net.Conn) *textproto.Conn {
+	conn = &ctxConn{Conn: conn, c: c}
+	if c.replyFilter != nil {
+		c.filterConn = newReplyFilterConn(conn, c.replyFilter)
+		conn = c.filterConn
+	}
+	if c.bareLF {
+		return textproto.NewConn(&bareLFConn{Conn: conn})
 	}
-	return c, w, err
+	return textproto.NewConn(conn)
+}
+
+// Command sends a command line formatted from format and args and reads
+// the server's reply, e.g. for extensions this package does not support.
+// The reply is checked against expectCode as by textproto.Reader's
+// ReadResponse: a three-digit code must match exactly, one or two digits
+// match as a prefix, and zero accepts any code; a mismatch returns a
+// *textproto.Error along with the code and text. Unlike writing to Text,
+// Command keeps the order of replies to pipelined commands intact and
+// passes the line to CommandHook. It must not be used to change the
+// state of the session, e.g. with STARTTLS or AUTH, which the Client
+// would not notice.
+func (c *Client) Command(expectCode int, format string, args ...interface{}) (int, string, error) {
+	return c.cmd(expectCode, format, args...)
 }
 
 // cmd is a convenience function that sends a command and returns the response
 func (c *Client) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
+	if c.CommandHook != nil {
+		line, err := c.hook(fmt.Sprintf(format, args...))
+		if err != nil {
+			return 0, "", err
+		}
+		format, args = "%s", []interface{}{line}
+	}
 	id, err := c.Text.Cmd(format, args...)
 	if err != nil {
 		return 0, "", err
@@ -183,24 +580,247 @@ func (c *Client) cmd(expectCode int, format string, args ...interface{}) (int, s
 	c.Text.StartResponse(id)
 	defer c.Text.EndResponse(id)
 	code, msg, err := c.Text.ReadResponse(expectCode)
+	c.noteReply(code, msg)
 	return code, msg, err
 }
 
+// hook passes line to CommandHook, if set, and returns the line to send.
+func (c *Client) hook(line string) (string, error) {
+	if c.CommandHook == nil {
+		return line, nil
+	}
+	verb, rest, _ := strings.Cut(line, " ")
+	return c.CommandHook(verb, rest)
+}
+
+// Reply is the server's response to one command of a pipelined batch,
+// see ReadReplies.
+type Reply struct {
+	Code int
+	Msg  string
+	// Err is a *textproto.Error if Code is not the expected one, or the
+	// error of the connection if no reply could be read.
+	Err error
+}
+
+// pipeline sends lines without waiting for the replies, which have to be
+// read with ReadReplies, and returns their textproto ids. Until then the
+// ids are pending and drained when the Client is closed. The lines are
+// passed to CommandHook first, and none is sent if it fails for one.
+func (c *Client) pipeline(lines []string) ([]uint, error) {
+	hooked := make([]string, len(lines))
+	for i, line := range lines {
+		var err error
+		if hooked[i], err = c.hook(line); err != nil {
+			return nil, err
+		}
+	}
+	ids := make([]uint, 0, len(lines))
+	for _, line := range hooked {
+		id, err := c.Text.Cmd("%s", line)
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+		c.pendingIDs = append(c.pendingIDs, id)
+	}
+	return ids, nil
+}
+
+// ReadReplies reads the responses to pipelined commands (RFC 2920), e.g.
+// written with Text.Cmd back-to-back without reading replies in between,
+// given the ids Text.Cmd returned for them. The reply to ids[i] is
+// returned at index i and checked against expectCodes[i] as by Command.
+// Once reading fails on the connection, the remaining replies get the
+// same error. Lines written with Text.Cmd bypass CommandHook.
+func (c *Client) ReadReplies(ids []uint, expectCodes []int) []Reply {
+	replies := make([]Reply, len(ids))
+	var connErr error
+	for i, id := range ids {
+		c.Text.StartResponse(id)
+		if connErr != nil {
+			replies[i].Err = connErr
+		} else {
+			code, msg, err := c.Text.ReadResponse(expectCodes[i])
+			c.noteReply(code, msg)
+			replies[i] = Reply{code, msg, err}
+			if _, ok := err.(*textproto.Error); err != nil && !ok {
+				connErr = err
+			}
+		}
+		c.Text.EndResponse(id)
+	}
+	c.donePending(ids)
+	return replies
+}
+
+// donePending removes ids whose replies were read from c.pendingIDs.
+func (c *Client) donePending(ids []uint) {
+	if len(c.pendingIDs) == 0 {
+		return
+	}
+	done := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		done[id] = true
+	}
+	pending := c.pendingIDs[:0]
+	for _, id := range c.pendingIDs {
+		if !done[id] {
+			pending = append(pending, id)
+		}
+	}
+	c.pendingIDs = pending
+}
+
+// drainTimeout limits how long drain waits for pending replies.
+const drainTimeout = 5 * time.Second
+
+// drain reads and discards the replies to pipelined commands that were
+// not read yet, waiting at most timeout, so the replies can not be taken
+// for those of later commands.
+func (c *Client) drain(timeout time.Duration) error {
+	if len(c.pendingIDs) == 0 {
+		return nil
+	}
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	defer c.conn.SetReadDeadline(c.deadline())
+	ids := append([]uint(nil), c.pendingIDs...)
+	for _, r := range c.ReadReplies(ids, make([]int, len(ids))) {
+		if _, ok := r.Err.(*textproto.Error); r.Err != nil && !ok {
+			return r.Err
+		}
+	}
+	return nil
+}
+
+// noteReply records whether a reply announces that the server is going
+// to close the connection.
+func (c *Client) noteReply(code int, msg string) {
+	switch enhancedCode(msg) {
+	case "4.3.2", "4.4.2":
+		// system not accepting network messages, bad connection
+		c.closing = true
+	}
+	if code == 421 {
+		c.closing = true
+	}
+}
+
+// Closing reports whether the server indicated that it is about to close
+// the connection, by replying 421 or with an enhanced status code such as
+// 4.3.2 (system not accepting network messages), e.g. to RSET. Such a
+// Client should not be reused for further transactions.
+func (c *Client) Closing() bool {
+	return c.closing
+}
+
+// GreetingMode tells how the Client greeted the server.
+type GreetingMode int
+
+const (
+	// GreetingNone means no greeting was accepted yet.
+	GreetingNone GreetingMode = iota
+	// GreetingEHLO means the server accepted EHLO and the extensions it
+	// advertised are known.
+	GreetingEHLO
+	// GreetingHELO means the server rejected EHLO and the Client fell
+	// back to HELO, so no extensions are known, even if the server
+	// supports some.
+	GreetingHELO
+)
+
+func (m GreetingMode) String() string {
+	switch m {
+	case GreetingEHLO:
+		return "EHLO"
+	case GreetingHELO:
+		return "HELO"
+	}
+	return "none"
+}
+
+// GreetingMode reports whether the session was greeted with EHLO or,
+// after EHLO was rejected, with HELO. It tells whether the lack of an
+// extension was advertised by the server or is due to the fallback.
+func (c *Client) GreetingMode() GreetingMode {
+	return c.greeting
+}
+
+// Greeting returns the text of the 220 greeting the server sent when the
+// connection was established, e.g. "mx.example.com ESMTP Postfix", often
+// naming the server software. Lines of a multiline greeting are
+// separated by "\n".
+func (c *Client) Greeting() string {
+	return c.banner
+}
+
+// Hello greets the server again with EHLO, falling back to HELO unless
+// StrictEHLO is set, announcing localName, e.g. the public host name of
+// the client, as identity, and uses it for later greetings. This resets
+// the session state, aborting an open mail transaction. Use
+// WithLocalName to also announce the name in the greeting sent by Dial
+// and NewClient.
+func (c *Client) Hello(localName string) error {
+	if err := checkLocalName(localName); err != nil {
+		return err
+	}
+	c.LocalName = localName
+	err := c.ehlo()
+	if err != nil && !c.StrictEHLO {
+		return c.helo()
+	}
+	return err
+}
+
+// checkLocalName returns an error if name can not be announced with
+// EHLO or HELO, e.g. because it would inject another command.
+func checkLocalName(name string) error {
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		return fmt.Errorf("invalid local name %q", name)
+	}
+	return nil
+}
+
+// localName returns the host name to greet the server with, or an error
+// if LocalName is invalid.
+func (c *Client) localName() (string, error) {
+	if c.LocalName == "" {
+		return "localhost", nil
+	}
+	return c.LocalName, checkLocalName(c.LocalName)
+}
+
 // helo sends the HELO greeting to the server. It should be used only when the
 // server does not support ehlo.
 func (c *Client) helo() error {
+	name, err := c.localName()
+	if err != nil {
+		return err
+	}
+	defer c.addPhase(PhaseEHLO, time.Now())
 	c.ext = nil
-	_, _, err := c.cmd(250, "HELO localhost")
+	_, _, err = c.cmd(250, "HELO %s", name)
+	if err == nil {
+		c.greeting = GreetingHELO
+		c.inTransaction = false
+	}
 	return err
 }
 
 // ehlo sends the EHLO (extended hello) greeting to the server. It
 // should be the preferred greeting for servers that support it.
 func (c *Client) ehlo() error {
-	_, msg, err := c.cmd(250, "EHLO localhost")
+	name, err := c.localName()
 	if err != nil {
 		return err
 	}
+	defer c.addPhase(PhaseEHLO, time.Now())
+	_, msg, err := c.cmd(250, "EHLO %s", name)
+	if err != nil {
+		return err
+	}
+	// forget what was advertised before, e.g. prior to STARTTLS
+	c.auth = nil
 	ext := make(map[string]string)
 	extList := strings.Split(msg, "\n")
 	if len(extList) > 1 {
@@ -218,103 +838,473 @@ func (c *Client) ehlo() error {
 		c.auth = strings.Split(mechs, " ")
 	}
 	c.ext = ext
+	c.greeting = GreetingEHLO
+	c.inTransaction = false
 	return err
 }
 
 // StartTLS sends the STARTTLS command and encrypts all further communication.
 // Only servers that advertise the STARTTLS extension support this function.
+// If data follows the server's reply before the handshake, StartTLS
+// closes the connection and returns an error wrapping
+// ErrSTARTTLSInjection.
 func (c *Client) StartTLS(config *tls.Config) error {
+	start := time.Now()
 	_, _, err := c.cmd(220, "STARTTLS")
+	c.addPhase(PhaseSTARTTLS, start)
 	if err != nil {
 		return err
 	}
-	c.conn = tls.Client(c.conn, config)
-	c.Text = textproto.NewConn(c.conn)
+	return c.upgradeTLS(config)
+}
+
+// upgradeTLS encrypts the connection after the server accepted STARTTLS.
+// Data received after the reply can only have been injected by an
+// attacker, to be taken for replies sent over TLS (CVE-2011-0411 and
+// kin), so the connection is closed instead.
+func (c *Client) upgradeTLS(config *tls.Config) error {
+	n := c.Text.R.Buffered()
+	if c.filterConn != nil {
+		n += c.filterConn.buffered()
+	}
+	if n > 0 {
+		c.Text.Close()
+		return fmt.Errorf("%w (%d bytes)", ErrSTARTTLSInjection, n)
+	}
+	start := time.Now()
+	tlsConn := tls.Client(c.conn, config)
+	if err := c.handshake(tlsConn); err != nil {
+		return err
+	}
+	c.addPhase(PhaseSTARTTLS, start)
+	c.conn = tlsConn
+	c.Text = c.newText(c.conn)
 	c.tls = true
-	return c.ehlo()
+
+	// what was learned before TLS must be discarded (RFC 3207 section
+	// 4.2), also if the EHLO fails
+	c.ext, c.auth, c.greeting = nil, nil, GreetingNone
+	err := c.ehlo()
+	if e, ok := err.(*textproto.Error); ok && e.Code/100 == 4 && c.ReEHLODelay > 0 {
+		// some servers refuse a quickly repeated EHLO for a moment
+		time.Sleep(c.ReEHLODelay)
+		err = c.ehlo()
+	}
+	return err
+}
+
+// handshake runs the TLS handshake on conn, if it has not completed yet,
+// and reports the negotiated state to OnTLSHandshake.
+func (c *Client) handshake(conn *tls.Conn) error {
+	if err := conn.HandshakeContext(c.context()); err != nil {
+		return err
+	}
+	if c.OnTLSHandshake != nil {
+		c.OnTLSHandshake(conn.ConnectionState())
+	}
+	return nil
 }
 
 // Verify checks the validity of an email address on the server.
-// If Verify returns nil, the address is valid. A non-nil return
-// does not necessarily indicate an invalid address. Many servers
-// will not verify addresses for security reasons.
+// If Verify returns nil, the address is valid or, with a 252 reply, the
+// server can not verify it but will attempt delivery; use VerifyStatus
+// to tell these apart. A non-nil return does not necessarily indicate an
+// invalid address. Many servers will not verify addresses for security
+// reasons.
 func (c *Client) Verify(addr string) error {
-	_, _, err := c.cmd(250, "VRFY %s", addr)
+	_, err := c.VerifyStatus(addr)
 	return err
 }
 
+// VerifyStatus is like Verify, but also reports whether the server
+// actually verified the address. A 252 reply returns verified false
+// and a nil error.
+func (c *Client) VerifyStatus(addr string) (verified bool, err error) {
+	code, _, err := c.cmd(25, "VRFY %s", addr)
+	return err == nil && code != 252, err
+}
+
+// VerifyList is like Verify, but returns every line of a multiline reply
+// instead of collapsing it, e.g. all candidates listed by a server that
+// answers an ambiguous address with 553. The entries are returned for
+// failed verifications as well.
+func (c *Client) VerifyList(addr string) ([]string, error) {
+	_, msg, err := c.cmd(25, "VRFY %s", addr)
+	return replyLines(msg), err
+}
+
+// Expand asks the server for the members of the mailing list with the
+// EXPN command and returns their addresses, taken from the angle
+// brackets of each line of the reply, or the whole line if it has none.
+// Many servers disable EXPN; their refusal, e.g. a 502 or 252 reply, is
+// returned as *SMTPError.
+func (c *Client) Expand(list string) ([]string, error) {
+	if list == "" || strings.ContainsAny(list, "\r\n") {
+		return nil, fmt.Errorf("invalid list name %q", list)
+	}
+	_, msg, err := c.cmd(250, "EXPN %s", list)
+	if e, ok := err.(*textproto.Error); ok {
+		return nil, newSMTPError(e)
+	}
+	if err != nil {
+		return nil, err
+	}
+	members := replyLines(msg)
+	for i, line := range members {
+		if l, r := strings.LastIndex(line, "<"), strings.LastIndex(line, ">"); l >= 0 && r > l {
+			members[i] = line[l+1 : r]
+		}
+	}
+	return members, nil
+}
+
+// Help sends the HELP command, with topic as argument unless it is
+// empty, and returns the text of the server's 214 reply, or of a 211
+// reply some servers answer with, lines separated by "\n".
+func (c *Client) Help(topic string) (string, error) {
+	if strings.ContainsAny(topic, "\r\n") {
+		return "", fmt.Errorf("invalid help topic %q", topic)
+	}
+	line := "HELP"
+	if topic != "" {
+		line += " " + topic
+	}
+	_, msg, err := c.cmd(21, "%s", line)
+	return msg, err
+}
+
+// replyLines splits the text of a multiline reply into its lines.
+func replyLines(msg string) []string {
+	if msg == "" {
+		return nil
+	}
+	return strings.Split(msg, "\n")
+}
+
 // Auth authenticates a client using the provided authentication mechanism.
 // A failed authentication closes the connection.
 // Only servers that advertise the AUTH extension support this function.
+// Mechanisms sending credentials in clear, such as PLAIN, LOGIN and
+// XOAUTH2, fail with ErrInsecureAuth on connections without TLS,
+// whatever the Auth implementation.
 func (c *Client) Auth(a Auth) error {
 	encoding := base64.StdEncoding
+	if c.log != nil {
+		c.log.unsafeAuth = c.UnsafeLogAuthCredentials
+	}
+	defer c.endAuthLog()
+	defer c.addPhase(PhaseAuth, time.Now())
 	mech, resp, err := a.Start(&ServerInfo{c.serverName, c.tls, c.auth})
+	c.authTried = mech
+	if err == nil && cleartextMechs[mech] && !c.tls {
+		err = ErrInsecureAuth
+	}
 	if err != nil {
 		c.Quit()
 		return err
 	}
-	resp64 := make([]byte, encoding.EncodedLen(len(resp)))
-	encoding.Encode(resp64, resp)
-	code, msg64, err := c.cmd(0, "AUTH %s %s", mech, resp64)
-	for err == nil {
+	line := "AUTH " + mech
+	if resp != nil {
+		// "=" is an empty initial response (RFC 4954 section 4)
+		resp64 := "="
+		if len(resp) > 0 {
+			resp64 = encoding.EncodeToString(resp)
+		}
+		line += " " + resp64
+	}
+	code, msg64, err := c.cmd(0, "%s", line)
+	maxChallenges := c.MaxAuthChallenges
+	if maxChallenges <= 0 {
+		maxChallenges = defaultMaxAuthChallenges
+	}
+	for challenges := 0; err == nil; {
 		var msg []byte
 		switch code {
 		case 334:
-			msg, err = encoding.DecodeString(msg64)
+			challenges++
+			if challenges > maxChallenges {
+				err = ErrTooManyAuthChallenges
+				break
+			}
+			if msg64 == "" {
+				// a bare 334 prompts for the response without data,
+				// which Next gets as an empty, non-nil challenge
+				msg = []byte{}
+			} else {
+				msg, err = encoding.DecodeString(msg64)
+			}
 		case 235:
 			// the last message isn't base64 because it isn't a challenge
 			msg = []byte(msg64)
 		default:
 			err = &textproto.Error{Code: code, Msg: msg64}
 		}
-		resp, err = a.Next(msg, code == 334)
+		if err == nil {
+			resp, err = a.Next(msg, code == 334)
+		}
 		if err != nil {
 			// abort the AUTH
 			c.cmd(501, "*")
+			c.endAuthLog()
 			c.Quit()
 			break
 		}
 		if resp == nil {
 			break
 		}
-		resp64 = make([]byte, encoding.EncodedLen(len(resp)))
-		encoding.Encode(resp64, resp)
-		code, msg64, err = c.cmd(0, string(resp64))
+		code, msg64, err = c.cmd(0, "%s", encoding.EncodeToString(resp))
+	}
+	if err == nil {
+		c.authMech = mech
 	}
 	return err
 }
 
+// AuthMechanisms returns the authentication mechanisms the server
+// advertised, e.g. to choose the Auth to pass to Auth.
+func (c *Client) AuthMechanisms() []string {
+	return append([]string(nil), c.auth...)
+}
+
+// AuthMechanism returns the mechanism of the last successful Auth, or
+// "" if the Client did not authenticate.
+func (c *Client) AuthMechanism() string {
+	return c.authMech
+}
+
+// endAuthLog resumes the protocol log after an AUTH exchange, which may
+// have ended without a final reply, e.g. when it was aborted.
+func (c *Client) endAuthLog() {
+	if c.log != nil {
+		c.log.authInProgress = false
+	}
+}
+
 // Mail issues a MAIL command to the server using the provided email address.
 // If the server supports the 8BITMIME extension, Mail adds the BODY=8BITMIME
 // parameter.
 // This initiates a mail transaction and is followed by one or more Rcpt calls.
+// A non-ASCII from address is sent with the SMTPUTF8 parameter, failing
+// with ErrSMTPUTF8Required if the server does not support it.
+// If the previous transaction is still open, Mail returns
+// ErrTransactionAlreadyOpen, or resets it first if AutoReset is set.
 func (c *Client) Mail(from string) error {
-	cmdStr := "MAIL FROM:<%s>"
+	return c.MailWithOptions(from, nil)
+}
+
+// MailSize is like Mail, but declares the size of the message in octets
+// with the SIZE parameter if the server supports the SIZE extension. If
+// size exceeds the limit the server advertised, MailSize returns an error
+// wrapping ErrMessageTooLarge without issuing the command.
+func (c *Client) MailSize(from string, size int64) error {
+	return c.MailWithOptions(from, &MailOptions{Size: size})
+}
+
+// MailRequireTLS is like Mail, but sends the REQUIRETLS parameter (RFC
+// 8689), demanding that the message is only relayed over TLS connections
+// with verified certificates on its way to the recipients. If the server
+// does not advertise REQUIRETLS, an error wrapping ErrNotSupported is
+// returned without issuing the command.
+func (c *Client) MailRequireTLS(from string) error {
+	return c.MailWithOptions(from, &MailOptions{RequireTLS: true})
+}
+
+// MailAuth is like Mail, but asserts authAs as the authenticated
+// submitter of the message with the AUTH parameter (RFC 4954 section 5),
+// e.g. for a gateway relaying on behalf of its users. An empty authAs or
+// "<>" asserts that the submitter is unknown. The parameter is only sent
+// if the server advertises AUTH.
+func (c *Client) MailAuth(from, authAs string) error {
+	if authAs == "" || authAs == "<>" {
+		return c.MailWithOptions(from, &MailOptions{AuthUnknown: true})
+	}
+	return c.MailWithOptions(from, &MailOptions{AuthSender: authAs})
+}
+
+// MailWithOptions is like Mail, but additionally appends the parameters
+// given in opts to the MAIL command. opts may be nil.
+func (c *Client) MailWithOptions(from string, opts *MailOptions) error {
+	defer c.addPhase(PhaseMail, time.Now())
+	if c.inTransaction {
+		if !c.AutoReset {
+			return ErrTransactionAlreadyOpen
+		}
+		if err := c.Reset(); err != nil {
+			return err
+		}
+	}
+	line, params, utf8, err := c.mailLine(from, opts)
+	if err != nil {
+		return err
+	}
+	c.mailParams = strings.Fields(params)
+	_, _, err = c.cmd(250, "%s", line)
+	c.inTransaction = err == nil
+	c.utf8 = utf8
+	return err
+}
+
+// mailLine returns the MAIL command for from and opts, its parameters and
+// whether it requests SMTPUTF8.
+func (c *Client) mailLine(from string, opts *MailOptions) (line, params string, utf8 bool, err error) {
 	if c.ext != nil {
 		if _, ok := c.ext["8BITMIME"]; ok {
-			cmdStr += " BODY=8BITMIME"
+			params += " BODY=8BITMIME"
 		}
 	}
-	_, _, err := c.cmd(250, cmdStr, from)
-	return err
+	utf8 = opts != nil && opts.UTF8 || !isASCII(from)
+	if utf8 {
+		if _, ok := c.ext["SMTPUTF8"]; !ok {
+			return "", "", false, fmt.Errorf("%w: not supported by the server", ErrSMTPUTF8Required)
+		}
+		params += " SMTPUTF8"
+	}
+	if opts != nil && opts.Size > 0 {
+		if _, ok := c.ext["SIZE"]; ok {
+			if max := c.Limits().MessageSize; max > 0 && opts.Size > max {
+				return "", "", false, fmt.Errorf("%w (%d octets, limit %d)", ErrMessageTooLarge, opts.Size, max)
+			}
+			params += " SIZE=" + strconv.FormatInt(opts.Size, 10)
+		}
+	}
+	if opts != nil && (opts.AuthSender != "" || opts.AuthUnknown) {
+		if _, ok := c.ext["AUTH"]; ok {
+			if opts.AuthUnknown {
+				params += " AUTH=<>"
+			} else {
+				params += " AUTH=" + xtext(opts.AuthSender)
+			}
+		}
+	}
+	if opts != nil && opts.RequireTLS {
+		if _, ok := c.ext["REQUIRETLS"]; !ok {
+			return "", "", false, fmt.Errorf("%w: REQUIRETLS", ErrNotSupported)
+		}
+		params += " REQUIRETLS"
+	}
+	if opts != nil && (opts.Return != "" || opts.EnvID != "") {
+		if opts.Return != "" && opts.Return != ReturnFull && opts.Return != ReturnHeaders {
+			return "", "", false, fmt.Errorf("invalid RET value %q", opts.Return)
+		}
+		if _, ok := c.ext["DSN"]; ok {
+			if opts.Return != "" {
+				params += " RET=" + opts.Return
+			}
+			if opts.EnvID != "" {
+				params += " ENVID=" + xtext(opts.EnvID)
+			}
+		}
+	}
+	if opts != nil {
+		extra, err := formatParams(opts.Extra)
+		if err != nil {
+			return "", "", false, err
+		}
+		params += extra
+	}
+	line = "MAIL FROM:" + formatPath(from, c.AddressSyntax) + params
+	if err := checkLine(line, c.Limits().MailLine); err != nil {
+		return "", "", false, err
+	}
+	return line, params, utf8, nil
 }
 
 // Rcpt issues a RCPT command to the server using the provided email address.
 // A call to Rcpt must be preceded by a call to Mail and may be followed by
 // a Data call or another Rcpt call.
+// Source-routed addresses are handled according to SourceRoutes.
 func (c *Client) Rcpt(to string) error {
-	_, _, err := c.cmd(25, "RCPT TO:<%s>", to)
+	return c.RcptWithOptions(to, nil)
+}
+
+// RcptWithOptions is like Rcpt, but additionally appends the parameters
+// given in opts to the RCPT command. opts may be nil.
+func (c *Client) RcptWithOptions(to string, opts *RcptOptions) error {
+	_, _, err := c.rcpt(to, opts)
 	return err
 }
 
+// RcptDSN is like Rcpt, but requests delivery status notifications for
+// the conditions in notify, e.g. "SUCCESS" and "FAILURE", reporting
+// orcpt as original recipient if not empty. The parameters are only sent
+// if the server supports the DSN extension (RFC 3461).
+func (c *Client) RcptDSN(to string, notify []string, orcpt string) error {
+	return c.RcptWithOptions(to, &RcptOptions{Notify: notify, ORCPT: orcpt})
+}
+
+// rcpt issues the RCPT command and returns the server's reply.
+// DSN parameters are only sent if the server supports the DSN extension.
+func (c *Client) rcpt(to string, opts *RcptOptions) (int, string, error) {
+	defer c.addPhase(PhaseRcpt, time.Now())
+	line, err := c.rcptLine(to, opts)
+	if err != nil {
+		return 0, "", err
+	}
+	// textproto treats a two-digit code as a prefix, so 25 accepts 250
+	// and 251 (user not local, will forward)
+	return c.cmd(25, "%s", line)
+}
+
+// rcptLine returns the RCPT command for to and opts.
+func (c *Client) rcptLine(to string, opts *RcptOptions) (string, error) {
+	to, err := applySourceRoutePolicy(to, c.SourceRoutes)
+	if err != nil {
+		return "", err
+	}
+	if !isASCII(to) && !c.utf8 {
+		if _, ok := c.ext["SMTPUTF8"]; !ok {
+			return "", fmt.Errorf("%w: not supported by the server", ErrSMTPUTF8Required)
+		}
+		return "", fmt.Errorf("%w: MAIL sent without it, see MailOptions.UTF8", ErrSMTPUTF8Required)
+	}
+	var params string
+	if opts != nil {
+		if err := checkNotify(opts.Notify); err != nil {
+			return "", err
+		}
+		if ok, _ := c.Extension("DSN"); ok {
+			if len(opts.Notify) > 0 {
+				params += " NOTIFY=" + strings.Join(opts.Notify, ",")
+			}
+			if opts.ORCPT != "" {
+				params += " ORCPT=rfc822;" + xtext(opts.ORCPT)
+			}
+		}
+		extra, err := formatParams(opts.Extra)
+		if err != nil {
+			return "", err
+		}
+		params += extra
+	}
+	line := "RCPT TO:" + formatPath(to, c.AddressSyntax) + params
+	if err := checkLine(line, c.Limits().RcptLine); err != nil {
+		return "", err
+	}
+	return line, nil
+}
+
 type dataCloser struct {
 	c *Client
 	io.WriteCloser
+	// reply to the message data, available after Close
+	msg string
+	// when the DATA command was issued
+	start time.Time
+	// reset the deadline set by DataWithDeadline
+	restoreDeadline bool
 }
 
 func (d *dataCloser) Close() error {
+	if d.restoreDeadline {
+		defer d.c.conn.SetDeadline(d.c.deadline())
+	}
 	d.WriteCloser.Close()
-	_, _, err := d.c.Text.ReadResponse(250)
+	d.c.Text.W.Flush()
+	code, msg, err := d.c.Text.ReadResponse(250)
+	d.c.noteReply(code, msg)
+	d.c.inTransaction = false
+	d.c.addPhase(PhaseData, d.start)
+	d.msg = msg
 	return err
 }
 
@@ -322,15 +1312,112 @@ func (d *dataCloser) Close() error {
 // can be used to write the data. The caller should close the writer
 // before calling any more methods on c.
 // A call to Data must be preceded by one or more calls to Rcpt.
+// Closing the writer terminates the data with CRLF "." CRLF, adding a
+// CRLF first if the message does not end with one, so the last line is
+// never merged with the final dot.
+// Bare LF line endings are converted to CRLF, in the whole message or,
+// with WithHeaderOnlyCRLF, only in its header.
+// If RequireTLSForData is set and the connection is not using TLS, Data
+// returns ErrTLSRequiredForData without issuing the DATA command.
 func (c *Client) Data() (io.WriteCloser, error) {
+	if c.RequireTLSForData && !c.tls {
+		return nil, ErrTLSRequiredForData
+	}
+	start := time.Now()
 	_, _, err := c.cmd(354, "DATA")
 	if err != nil {
+		c.addPhase(PhaseData, start)
+		return nil, err
+	}
+	w := c.Text.W
+	if c.DataTee != nil {
+		// flushed into c.Text.W, which dataCloser flushes in turn
+		w = bufio.NewWriter(io.MultiWriter(c.Text.W, c.DataTee))
+	}
+	if c.headerOnlyCRLF {
+		return &dataCloser{c: c, WriteCloser: newHeaderDotWriter(w), start: start}, nil
+	}
+	return &dataCloser{c: c, WriteCloser: textproto.NewWriter(w).DotWriter(), start: start}, nil
+}
+
+// DataRaw is like Data, but returns the dot-stuffing writer and the step
+// completing the transaction separately, so the caller can place its own
+// transform (e.g. a compressor required by a relay) in between.
+// The message is written to w, after which done must be called, which
+// terminates the data with the final dot and reads the server's reply.
+func (c *Client) DataRaw() (w io.Writer, done func() error, err error) {
+	wc, err := c.Data()
+	if err != nil {
+		return nil, nil, err
+	}
+	return wc.(*dataCloser).WriteCloser, wc.Close, nil
+}
+
+// Burl issues a BURL command (RFC 4468) making the server fetch the
+// message data, or with lastChunk false a part of it, from the IMAP URL
+// url, e.g. a draft saved on the IMAP server, instead of sending it with
+// Data. A call to Burl must be preceded by one or more calls to Rcpt.
+// If the server does not advertise BURL, an error wrapping
+// ErrNotSupported is returned without issuing the command.
+func (c *Client) Burl(url string, lastChunk bool) error {
+	if ok, _ := c.Extension("BURL"); !ok {
+		return fmt.Errorf("%w: BURL", ErrNotSupported)
+	}
+	if url == "" || strings.ContainsAny(url, " \t\r\n") {
+		return fmt.Errorf("invalid BURL URL %q", url)
+	}
+	line := "BURL " + url
+	if lastChunk {
+		line += " LAST"
+	}
+	_, _, err := c.cmd(250, "%s", line)
+	if lastChunk {
+		c.inTransaction = false
+	}
+	return err
+}
+
+// SendIfAccepted runs a mail transaction that only transfers msg if the
+// server accepts every recipient, e.g. to test addresses and send on
+// success without a second connection. If a recipient is rejected, the
+// transaction is aborted with RSET and ErrRecipientRejected is returned
+// along with the outcome of each RCPT command, leaving the Client ready
+// for the next transaction.
+func (c *Client) SendIfAccepted(from string, to []string, msg io.Reader) ([]RcptResult, error) {
+	if err := c.Mail(from); err != nil {
 		return nil, err
 	}
-	return &dataCloser{c, c.Text.DotWriter()}, nil
+	var (
+		results  []RcptResult
+		rejected bool
+	)
+	for _, addr := range to {
+		code, m, err := c.rcpt(addr, nil)
+		results = append(results, newRcptResult(addr, code, m, err))
+		if _, ok := err.(*textproto.Error); ok {
+			rejected = true
+		} else if err != nil {
+			return results, err
+		}
+	}
+	if rejected {
+		if err := c.Reset(); err != nil {
+			return results, err
+		}
+		return results, ErrRecipientRejected
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return results, err
+	}
+	if _, err := io.Copy(w, msg); err != nil {
+		return results, err
+	}
+	return results, w.Close()
 }
 
-//Helper function to iterate over authentication array
+// Helper function to iterate over authentication array
 func stringInArray(a string, list []string) bool {
 	for _, b := range list {
 		if b == a {
@@ -343,114 +1430,408 @@ func stringInArray(a string, list []string) bool {
 // SendMail connects to the server at addr, switches to TLS if possible,
 // authenticates with mechanism a if possible, and then sends an email from
 // address from, to addresses to, with message msg.
+// It returns the protocol log, which is also returned along with errors
+// occurring after the connection was established.
 func SendMail(addr string, aplain Auth, acram Auth, from string, to []string, msg []byte) ([]byte, error) {
-
-	c, sbytelog, err := Dial(addr)
-	if err != nil {
+	res, err := SendMailResult(addr, aplain, acram, from, to, msg)
+	if res == nil {
 		return nil, err
 	}
-	if ok, _ := c.Extension("STARTTLS"); ok {
-		config := &tls.Config{ServerName: c.serverName}
+	return res.Transcript, err
+}
 
-		if err = c.StartTLS(config); err != nil {
-			return nil, err
-		}
+// SendMailSSL does essentially the same thing as SendMail, differing in
+// that it connects over an explicit TLS channel instead of trying STARTTLS.
+func SendMailSSL(addr string, aplain Auth, acram Auth, from string, to []string, msg []byte) ([]byte, error) {
+	res, err := SendMailSSLResult(addr, aplain, acram, from, to, msg)
+	if res == nil {
+		return nil, err
 	}
+	return res.Transcript, err
+}
 
-	var a = aplain
-	if stringInArray("CRAM-MD5", c.auth) {
-		a = acram
+// SendMailTLS is like SendMail, but uses config for STARTTLS, e.g. to
+// set a minimum TLS version, pin the certificate of the server in
+// VerifyPeerCertificate or present a client certificate. The server name
+// is filled in if empty.
+func SendMailTLS(addr string, config *tls.Config, aplain Auth, acram Auth, from string, to []string, msg []byte) ([]byte, error) {
+	res, err := SendMailWithOptions(addr, aplain, acram, from, to, msg, &SendOptions{TLSConfig: config})
+	if res == nil {
+		return nil, err
 	}
+	return res.Transcript, err
+}
 
-	if a != nil && c.ext != nil {
-		if _, ok := c.ext["AUTH"]; ok {
-			if err = c.Auth(a); err != nil {
-				return nil, err
-			}
-		}
-	}
-	if err = c.Mail(from); err != nil {
+// SendMailSSLConfig is like SendMailSSL, but uses config for the TLS
+// channel, see SendMailTLS.
+func SendMailSSLConfig(addr string, config *tls.Config, aplain Auth, acram Auth, from string, to []string, msg []byte) ([]byte, error) {
+	res, err := SendMailWithOptions(addr, aplain, acram, from, to, msg, &SendOptions{SSL: true, TLSConfig: config})
+	if res == nil {
 		return nil, err
 	}
-	for _, addr := range to {
-		if err = c.Rcpt(addr); err != nil {
-			return nil, err
-		}
+	return res.Transcript, err
+}
+
+// SendMailResult is like SendMail, but returns a SendResult holding the
+// transcript and the outcome of the session. Once connected, the result is
+// returned even if sending fails, filled as far as the session got.
+func SendMailResult(addr string, aplain Auth, acram Auth, from string, to []string, msg []byte) (*SendResult, error) {
+	return SendMailWithOptions(addr, aplain, acram, from, to, msg, nil)
+}
+
+// SendMailSSLResult is like SendMailSSL, but returns a SendResult as
+// described for SendMailResult.
+func SendMailSSLResult(addr string, aplain Auth, acram Auth, from string, to []string, msg []byte) (*SendResult, error) {
+	return SendMailWithOptions(addr, aplain, acram, from, to, msg, &SendOptions{SSL: true})
+}
+
+// SendMailPartial is like SendMailResult, but delivers the message to
+// the recipients the server accepts even if it rejects others, see
+// SendOptions.AllowPartial. The rejected recipients are those with a
+// non-nil Err in the Recipients of the result, e.g. to retry only them.
+func SendMailPartial(addr string, aplain Auth, acram Auth, from string, to []string, msg []byte) (*SendResult, error) {
+	return SendMailWithOptions(addr, aplain, acram, from, to, msg, &SendOptions{AllowPartial: true})
+}
+
+// SendLocal hands msg to the MTA on the local host, e.g. from scripts
+// and cron jobs. It submits to port 587 without authentication, using
+// STARTTLS if offered, and falls back to port 25 if that fails before
+// the message data was sent, e.g. because nothing listens on 587 or it
+// requires authentication. Port 25 uses STARTTLS if offered without
+// verifying the certificate, as local MTAs often have self-signed ones.
+func SendLocal(from string, to []string, msg []byte) error {
+	return sendLocal(from, to, msg, nil)
+}
+
+// sendLocal is SendLocal using a Client configured by opts.
+func sendLocal(from string, to []string, msg []byte, opts []Option) error {
+	res, err := SendMailWithOptions("localhost:587", nil, nil, from, to, msg, &SendOptions{ClientOptions: opts, PlaintextFallback: true})
+	var dataErr *DataError
+	// after the data was sent, the message may have been delivered
+	if err == nil || errors.As(err, &dataErr) || res != nil && res.Accepted {
+		return err
 	}
-	w, err := c.Data()
-	if err != nil {
-		return nil, err
+	_, err = SendMailWithOptions("localhost:25", nil, nil, from, to, msg, &SendOptions{
+		ClientOptions:     opts,
+		PlaintextFallback: true,
+		TLSConfig:         &tls.Config{InsecureSkipVerify: true},
+	})
+	return err
+}
+
+// SendMailWithOptions is like SendMailResult, with the session further
+// controlled by opts, which may be nil.
+//
+// Like all send helpers, it returns rejections by the server as an
+// *SMTPError and errors of the connection wrapped in ErrNetwork, so
+// retry logic can tell them apart with errors.As and errors.Is. Once
+// connected, errors are wrapped in an AuthError, MailError, RcptError or
+// DataError telling the stage that failed.
+func SendMailWithOptions(addr string, aplain Auth, acram Auth, from string, to []string, msg []byte, opts *SendOptions) (*SendResult, error) {
+	return sendMail(addr, aplain, acram, from, to, bytes.NewReader(msg), int64(len(msg)), opts)
+}
+
+// SendMailReader is like SendMailWithOptions, but reads the message from
+// r, which need not be seekable. The message is buffered, in memory up to
+// opts.SpoolMemory bytes and in a temporary file beyond that, so its size
+// can be declared to servers supporting the SIZE extension.
+func SendMailReader(addr string, aplain Auth, acram Auth, from string, to []string, r io.Reader, opts *SendOptions) (*SendResult, error) {
+	memLimit := int64(DefaultSpoolMemory)
+	if opts != nil && opts.SpoolMemory > 0 {
+		memLimit = opts.SpoolMemory
 	}
-	_, err = w.Write(msg)
+	s, err := newSpool(r, memLimit)
 	if err != nil {
 		return nil, err
 	}
-	err = w.Close()
+	defer s.Close()
+	return sendMail(addr, aplain, acram, from, to, s.Reader(), s.size, opts)
+}
+
+// sendMail runs a session submitting the size bytes read from msg. A size
+// of zero is not declared to the server.
+func sendMail(addr string, aplain Auth, acram Auth, from string, to []string, msg io.Reader, size int64, opts *SendOptions) (*SendResult, error) {
+	if opts == nil {
+		opts = &SendOptions{}
+	}
+	start := time.Now()
+
+	c, err := connect(addr, opts)
+	if c == nil {
+		return nil, sendError(err)
+	}
+	res := &SendResult{}
+	if err == nil {
+		err = c.send(aplain, acram, from, to, msg, size, opts, res)
+	}
+	return c.finish(res, start, err)
+}
+
+// connect dials addr and switches to TLS as configured by opts. If it
+// fails after the connection was established, the Client is returned
+// along with the error, so its transcript is available.
+func connect(addr string, opts *SendOptions) (*Client, error) {
+	var (
+		c   *Client
+		err error
+	)
+	if opts.SSL {
+		c, err = dialSSL(addr, opts.TLSConfig, opts.ClientOptions)
+	} else {
+		c, _, err = Dial(addr, opts.ClientOptions...)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return sbytelog.smtplog, c.Quit()
+
+	if ok, _ := c.Extension("STARTTLS"); ok && !opts.SSL {
+		config := tlsConfig(opts.TLSConfig, c.serverName)
+
+		start := time.Now()
+		_, _, err = c.cmd(220, "STARTTLS")
+		c.addPhase(PhaseSTARTTLS, start)
+		if err != nil && opts.PlaintextFallback && !opts.RequireTLS {
+			// the connection is in an undefined state, start over
+			c.Close()
+			first := c.log.w.smtplog
+			if c, _, err = Dial(addr, opts.ClientOptions...); err != nil {
+				return nil, err
+			}
+			c.log.w.smtplog = append(first, c.log.w.smtplog...)
+		} else if err == nil {
+			err = c.upgradeTLS(config)
+		}
+		return c, err
+	} else if opts.RequireTLS && !opts.SSL {
+		return c, ErrTLSRequired
+	}
+	return c, nil
 }
 
-//SendMailSSL does essentially the same thing as SendMail, differing in
-//that it connects over an explicit TLS channel instead of trying STARTTLS.
-func SendMailSSL(addr string, aplain Auth, acram Auth, from string, to []string, msg []byte) ([]byte, error) {
+// tlsConfig returns a copy of config, or an empty configuration if it is
+// nil, with the server name set to host unless already set.
+func tlsConfig(config *tls.Config, host string) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	return config
+}
 
-	host := addr[:strings.Index(addr, ":")]
+// dialSSL connects to addr over an explicit TLS channel configured by
+// config, which may be nil.
+func dialSSL(addr string, config *tls.Config, opts []Option) (*Client, error) {
 
-	conn, err := tls.Dial("tcp", addr, nil)
+	host := hostOf(addr)
 
+	c := newClient(opts)
+	conn, err := c.dial(addr)
 	if err != nil {
 
 		return nil, err
 	}
 
-	c, sbytelog, err := NewClient(conn, host)
-	if err != nil {
+	tlsConn := tls.Client(conn, tlsConfig(config, host))
+	c, _, err = c.start(tlsConn, host)
+	return c, err
+}
 
-		return nil, err
+// send authenticates if possible and submits msg, declaring size if not
+// zero, in a single mail transaction, recording the outcome in res.
+func (c *Client) send(aplain Auth, acram Auth, from string, to []string, msg io.Reader, size int64, opts *SendOptions, res *SendResult) error {
+	if err := c.authenticate(aplain, acram, opts, res); err != nil {
+		return err
+	}
+	return c.transaction(from, to, msg, size, opts, res)
+}
+
+// authenticate authenticates with acram if the server supports CRAM-MD5,
+// otherwise with aplain, if AUTH is advertised and credentials are given.
+// It records the TLS state, the mechanism used and why the advertised
+// ones were chosen or skipped in res.
+func (c *Client) authenticate(aplain Auth, acram Auth, opts *SendOptions, res *SendResult) error {
+	if state, ok := c.TLSConnectionState(); ok {
+		res.TLS = &state
 	}
 
 	var a = aplain
-	if stringInArray("CRAM-MD5", c.auth) {
+	cram := stringInArray("CRAM-MD5", c.auth) && acram != nil
+	if cram {
 		a = acram
 	}
 
-	if a != nil {
-		if ok, _ := c.Extension("AUTH"); ok {
-			if err = c.Auth(a); err != nil {
-
-				return nil, err
-			}
+	advertised, _ := c.Extension("AUTH")
+	if a != nil && advertised {
+		err := c.Auth(a)
+		res.AuthDecisions = authDecisions(c.auth, c.authTried, err, aplain != nil, acram != nil, cram)
+		if err != nil {
+			return &AuthError{sendError(err)}
+		}
+		res.AuthMechanism = c.authMech
+	} else if advertised {
+		res.AuthDecisions = authDecisions(c.auth, "", nil, aplain != nil, acram != nil, false)
+		if opts.RequireAuth {
+			return &AuthError{ErrAuthRequired}
 		}
 	}
+	return nil
+}
 
-	if err = c.Mail(from); err != nil {
-		return nil, err
+// transaction submits msg, declaring size if not zero, in a single mail
+// transaction on an authenticated Client, recording the outcome in res.
+func (c *Client) transaction(from string, to []string, msg io.Reader, size int64, opts *SendOptions, res *SendResult) error {
+	c.mailParams = nil
+	utf8 := !isASCII(from)
+	for _, addr := range to {
+		utf8 = utf8 || !isASCII(addr)
+	}
+	mopts := &MailOptions{Size: size, Return: opts.Return, EnvID: opts.EnvID, UTF8: utf8}
+	var (
+		replies []Reply
+		err     error
+	)
+	if ok, _ := c.Extension("PIPELINING"); ok && !c.inTransaction {
+		replies, err = c.pipelineEnvelope(from, to, mopts, opts)
+	}
+	if replies == nil && err == nil {
+		err = c.MailWithOptions(from, mopts)
+	}
+	res.MailParams = c.mailParams
+	if err != nil {
+		if e, ok := err.(*textproto.Error); ok && e.Code == 530 && res.AuthMechanism == "" {
+			err = fmt.Errorf("%w: %w", ErrAuthRequired, newSMTPError(e))
+		}
+		return &MailError{sendError(err)}
 	}
 
-	for _, addr := range to {
-		if err = c.Rcpt(addr); err != nil {
-			return nil, err
+	var (
+		accepted int
+		rejected *RcptError
+	)
+	for i, addr := range to {
+		var (
+			code int
+			msg  string
+			err  error
+		)
+		if replies != nil {
+			code, msg, err = replies[i].Code, replies[i].Msg, replies[i].Err
+		} else {
+			code, msg, err = c.rcpt(addr, rcptOptions(addr, opts))
+		}
+		res.Recipients = append(res.Recipients, newRcptResult(addr, code, msg, err))
+		if e, ok := err.(*textproto.Error); ok && opts.AllowPartial {
+			rejected = &RcptError{addr, fmt.Errorf("%w: %w", ErrRecipientRejected, newSMTPError(e))}
+		} else if err != nil {
+			return &RcptError{addr, sendError(err)}
+		} else {
+			accepted++
 		}
 	}
+	if accepted == 0 && rejected != nil {
+		return rejected
+	}
 
 	w, err := c.Data()
 	if err != nil {
-		return nil, err
+		return &DataError{sendError(err)}
 	}
 
-	_, err = w.Write(msg)
+	_, err = io.Copy(w, msg)
 	if err != nil {
-		return nil, err
+		return &DataError{sendError(err)}
 	}
 
 	err = w.Close()
 	if err != nil {
+		return &DataError{sendError(err)}
+	}
+	res.Accepted = true
+	res.QueueID = queueID(w.(*dataCloser).msg)
+	return nil
+}
+
+// rcptOptions returns the parameters of the RCPT command for addr sent
+// by the send helpers.
+func rcptOptions(addr string, opts *SendOptions) *RcptOptions {
+	if len(opts.Notify) == 0 {
+		return nil
+	}
+	// ORCPT has to name this very recipient
+	return &RcptOptions{Notify: opts.Notify, ORCPT: addr}
+}
+
+// pipelineEnvelope sends the MAIL command and the RCPT commands for all
+// of to at once, as the server supports PIPELINING (RFC 2920), and
+// returns the replies to the RCPT commands or the error of the MAIL
+// command. It returns neither if a command can not be built, so the
+// transaction falls back to sending them one by one, which reports the
+// error at the command it belongs to. The whole exchange counts as
+// PhaseMail.
+func (c *Client) pipelineEnvelope(from string, to []string, mopts *MailOptions, opts *SendOptions) ([]Reply, error) {
+	line, params, utf8, err := c.mailLine(from, mopts)
+	if err != nil {
+		return nil, err
+	}
+	lines := []string{line}
+	expect := []int{250}
+	// the RCPT lines depend on whether MAIL requests SMTPUTF8
+	c.utf8 = utf8
+	for _, addr := range to {
+		line, err := c.rcptLine(addr, rcptOptions(addr, opts))
+		if err != nil {
+			return nil, nil
+		}
+		lines = append(lines, line)
+		expect = append(expect, 25)
+	}
+	defer c.addPhase(PhaseMail, time.Now())
+	c.mailParams = strings.Fields(params)
+	ids, err := c.pipeline(lines)
+	if err != nil {
+		return nil, err
+	}
+	replies := c.ReadReplies(ids, expect)
+	if err := replies[0].Err; err != nil {
 		return nil, err
 	}
+	c.inTransaction = true
+	return replies[1:], nil
+}
+
+// finish ends a session started by one of the send helpers at start. It
+// quits, or after a failure closes, the connection and stores the
+// transcript and statistics in res.
+func (c *Client) finish(res *SendResult, start time.Time, err error) (*SendResult, error) {
+	if err != nil {
+		c.Close()
+	} else {
+		err = c.Quit()
+	}
+	res.Transcript = c.log.w.smtplog
+	res.BytesSent = c.log.written
+	res.PhaseTimings = c.PhaseTimings()
+	res.Elapsed = time.Since(start)
+	return res, sendError(err)
+}
 
-	return sbytelog.smtplog, c.Quit()
+// TLSConnectionState returns the state of the TLS connection, e.g. the
+// negotiated version and cipher suite and the certificate chain of the
+// server, after StartTLS or on a connection using implicit TLS. The bool
+// is false if the connection does not use TLS.
+func (c *Client) TLSConnectionState() (tls.ConnectionState, bool) {
+	conn := c.conn
+	if l, ok := conn.(*logProxy); ok {
+		conn = l.Conn
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		return tc.ConnectionState(), true
+	}
+	return tls.ConnectionState{}, false
 }
 
 // Extension reports whether an extension is support by the server.
@@ -466,18 +1847,118 @@ func (c *Client) Extension(ext string) (bool, string) {
 	return ok, param
 }
 
+// Extensions returns a copy of all extensions the server advertised in
+// its EHLO reply, mapping each keyword to its parameters, including
+// those this package does not handle. It is nil without an EHLO reply,
+// e.g. after the fallback to HELO.
+func (c *Client) Extensions() map[string]string {
+	if c.ext == nil {
+		return nil
+	}
+	ext := make(map[string]string, len(c.ext))
+	for k, v := range c.ext {
+		ext[k] = v
+	}
+	return ext
+}
+
 // Reset sends the RSET command to the server, aborting the current mail
 // transaction.
 func (c *Client) Reset() error {
 	_, _, err := c.cmd(250, "RSET")
+	if err == nil {
+		c.inTransaction = false
+	}
+	return err
+}
+
+// Noop sends the NOOP command to the server, e.g. to check that an idle
+// connection is still alive before reusing it and to reset the idle
+// timer of the server.
+func (c *Client) Noop() error {
+	_, _, err := c.cmd(250, "NOOP")
 	return err
 }
 
+// Ping checks with NOOP whether the connection is still usable, e.g.
+// before handing out a pooled Client. It returns an error wrapping
+// ErrConnClosed and the cause if the connection is closed or broken, or
+// the server replied with 421 to announce closing it. Any other reply
+// shows the connection is alive and returns nil.
+func (c *Client) Ping() error {
+	if c.closed {
+		return ErrConnClosed
+	}
+	code, _, err := c.cmd(250, "NOOP")
+	if _, ok := err.(*textproto.Error); ok && code != 421 {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrConnClosed, err)
+	}
+	return nil
+}
+
 // Quit sends the QUIT command and closes the connection to the server.
+// A server closing the connection instead of replying to QUIT, or right
+// after replying, is not treated as an error.
+// If AsyncQuit is set, the reply is not waited for.
+// Once the connection was closed by Quit or Close, Quit does nothing and
+// returns nil, so it may be called again, e.g. in a deferred cleanup.
 func (c *Client) Quit() error {
-	_, _, err := c.cmd(221, "QUIT")
+	if c.closed {
+		return nil
+	}
+	id, err := c.Text.Cmd("QUIT")
 	if err != nil {
 		return err
 	}
+	c.closed = true
+	defer c.unwatch()
+	if c.AsyncQuit {
+		return c.Text.Close()
+	}
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(221)
+	c.Text.EndResponse(id)
+	if err != nil && !isConnClosed(err) {
+		c.Text.Close()
+		return err
+	}
+	return c.Text.Close()
+}
+
+// isConnClosed reports whether err indicates that the server closed
+// the connection.
+func isConnClosed(err error) bool {
+	return err == io.EOF || err == io.ErrUnexpectedEOF || errors.Is(err, syscall.ECONNRESET)
+}
+
+// Conn returns the connection the Client was created with, without the
+// protocol logging wrapper, e.g. to read TCP info or set socket options.
+// For connections using implicit TLS this is the *tls.Conn, whose
+// NetConn method returns the underlying socket. After StartTLS, the
+// returned connection still is the unencrypted one below TLS.
+// Reading from or writing to the connection directly corrupts the
+// protocol state of the Client.
+func (c *Client) Conn() net.Conn {
+	if c.log != nil {
+		return c.log.Conn
+	}
+	return c.conn
+}
+
+// Close closes the connection without sending QUIT. Replies to pipelined
+// commands still in flight are read first, waiting a few seconds at most.
+// Like Quit, it returns nil if the connection was closed already.
+func (c *Client) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.conn != nil {
+		c.drain(drainTimeout)
+	}
+	c.unwatch()
 	return c.Text.Close()
 }
@@ -32,10 +32,22 @@ package smtpssl
 import (
 	"bufio"
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
+	"math/big"
 	"net"
 	"net/textproto"
+	"reflect"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -51,6 +63,8 @@ var authTests = []authTest{
 	{PlainAuth("", "user", "pass", "testserver"), []string{}, "PLAIN", []string{"\x00user\x00pass"}},
 	{PlainAuth("foo", "bar", "baz", "testserver"), []string{}, "PLAIN", []string{"foo\x00bar\x00baz"}},
 	{CRAMMD5Auth("user", "pass"), []string{"<123456.1322876914@testserver>"}, "CRAM-MD5", []string{"", "user 287eb355114cf5c471c26a875f1ca4ae"}},
+	{LoginAuth("user", "pass", "testserver"), []string{"Username:", "Password:"}, "LOGIN", []string{"", "user", "pass"}},
+	{LoginAuth("user", "pass", "testserver"), []string{"", ""}, "LOGIN", []string{"", "user", "pass"}},
 }
 
 func TestAuth(t *testing.T) {
@@ -82,6 +96,106 @@ testLoop:
 	}
 }
 
+func TestXOAuth2Auth(t *testing.T) {
+	resp64 := base64.StdEncoding.EncodeToString([]byte("user=user@example.com\x01auth=Bearer token\x01\x01"))
+
+	c, out := newFakeClient("235 2.7.0 Accepted\n")
+	c.auth = []string{"PLAIN", "XOAUTH2"}
+	c.tls = true
+	if err := c.Auth(XOAuth2Auth("user@example.com", "token")); err != nil {
+		t.Fatalf("Auth failed: %s", err)
+	}
+	if expected := "AUTH XOAUTH2 " + resp64 + "\n"; out() != expected {
+		t.Errorf("Expected %q", expected)
+	}
+
+	c, out = newFakeClient("334 eyJzdGF0dXMiOiI0MDEifQ==\n535 5.7.8 Bad token\n")
+	c.auth = []string{"XOAUTH2"}
+	c.tls = true
+	if err := c.Auth(XOAuth2Auth("user@example.com", "token")); err == nil {
+		t.Fatalf("Expected the rejected token to fail")
+	}
+	if expected := "AUTH XOAUTH2 " + resp64 + "\n\n"; !strings.HasPrefix(out(), expected) {
+		t.Errorf("Expected an empty response to the error challenge, %q", expected)
+	}
+
+	a := XOAuth2Auth("user@example.com", "token")
+	if _, _, err := a.Start(&ServerInfo{"testserver", true, []string{"PLAIN"}}); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Expected ErrNotSupported, got %v", err)
+	}
+	a = XOAuth2Auth("user@example.com", "token\x01auth=Bearer other")
+	if _, _, err := a.Start(&ServerInfo{"testserver", true, []string{"XOAUTH2"}}); err != ErrInvalidCredentials {
+		t.Errorf("Expected ErrInvalidCredentials, got %v", err)
+	}
+}
+
+func TestLoginAuthRequiresTLS(t *testing.T) {
+	if _, _, err := LoginAuth("user", "pass", "testserver").Start(&ServerInfo{"testserver", false, []string{"LOGIN"}}); err == nil {
+		t.Errorf("LOGIN allowed without TLS")
+	}
+	if _, _, err := LoginAuth("user", "pass", "testserver").Start(&ServerInfo{"attacker", true, []string{"LOGIN"}}); err == nil {
+		t.Errorf("LOGIN allowed to the wrong host")
+	}
+}
+
+// carelessAuth returns a mechanism and credentials without any checks.
+type carelessAuth struct{ mech string }
+
+func (a carelessAuth) Start(server *ServerInfo) (string, []byte, error) {
+	return a.mech, []byte("secret"), nil
+}
+
+func (a carelessAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	return []byte("secret"), nil
+}
+
+func TestInsecureAuth(t *testing.T) {
+	tests := []struct {
+		auth     Auth
+		insecure bool
+	}{
+		{PlainAuth("", "user", "secret", "testserver"), true},
+		{LoginAuth("user", "secret", "testserver"), true},
+		{XOAuth2Auth("user", "secret"), true},
+		{carelessAuth{"PLAIN"}, true},
+		{carelessAuth{"LOGIN"}, true},
+		{carelessAuth{"X-CUSTOM"}, false},
+		{CRAMMD5Auth("user", "secret"), false},
+	}
+	for i, tt := range tests {
+		c, out := newFakeClient("235 Accepted\n")
+		c.serverName = "testserver"
+		c.auth = []string{"PLAIN", "LOGIN", "XOAUTH2", "X-CUSTOM", "CRAM-MD5"}
+		err := c.Auth(tt.auth)
+		if insecure := err == ErrInsecureAuth; insecure != tt.insecure {
+			t.Errorf("#%d: got %v", i, err)
+		}
+		if sent := out(); tt.insecure && (strings.Contains(sent, "AUTH") || sent != "QUIT\n") {
+			t.Errorf("#%d: sent %q over plaintext", i, sent)
+		}
+	}
+}
+
+func TestPlainAuthInvalidCredentials(t *testing.T) {
+	tests := []struct{ identity, username, password string }{
+		{"", "user", "pa\x00ss"},
+		{"", "user\x00admin", "pass"},
+		{"admin\x00", "user", "pass"},
+		{"", "user", "pass\r\nMAIL FROM:<evil@example.com>"},
+		{"", "user\n", "pass"},
+	}
+	for i, test := range tests {
+		a := PlainAuth(test.identity, test.username, test.password, "testserver")
+		_, resp, err := a.Start(&ServerInfo{"testserver", true, nil})
+		if err != ErrInvalidCredentials {
+			t.Errorf("#%d: expected ErrInvalidCredentials, got %v", i, err)
+		}
+		if resp != nil {
+			t.Errorf("#%d: expected no response, got %q", i, resp)
+		}
+	}
+}
+
 type faker struct {
 	io.ReadWriter
 }
@@ -124,8 +238,8 @@ func TestBasic(t *testing.T) {
 		t.Fatalf("MAIL should require authentication")
 	}
 
-	if err := c.Verify("user1@gmail.com"); err == nil {
-		t.Fatalf("First VRFY: expected no verification")
+	if verified, err := c.VerifyStatus("user1@gmail.com"); verified || err != nil {
+		t.Fatalf("First VRFY: expected no verification without error, got %v", err)
 	}
 	if err := c.Verify("user2@gmail.com"); err != nil {
 		t.Fatalf("Second VRFY: expected verification, got %s", err)
@@ -298,3 +412,2273 @@ var newClient2Client = `EHLO localhost
 HELO localhost
 QUIT
 `
+
+// newFakeClient returns a Client talking to a fake server that replies with
+// the given lines, and a func returning the commands written so far.
+func newFakeClient(server string) (*Client, func() string) {
+	server = strings.Join(strings.Split(server, "\n"), "\r\n")
+	var cmdbuf bytes.Buffer
+	bcmdbuf := bufio.NewWriter(&cmdbuf)
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+	c := &Client{Text: textproto.NewConn(fake)}
+	return c, func() string {
+		bcmdbuf.Flush()
+		return strings.Replace(cmdbuf.String(), "\r\n", "\n", -1)
+	}
+}
+
+func TestExtraParams(t *testing.T) {
+	c, out := newFakeClient(`250 Sender OK
+250 Receiver OK
+`)
+	c.ext = map[string]string{"8BITMIME": ""}
+	err := c.MailWithOptions("user@example.com", &MailOptions{Extra: []Param{{"X-PRIORITY", "high value"}, {"X-FLAG", ""}}})
+	if err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+	if err := c.RcptWithOptions("rcpt@example.com", &RcptOptions{Extra: []Param{{"X-ID", "a+b=c"}}}); err != nil {
+		t.Fatalf("RCPT failed: %s", err)
+	}
+	if err := c.MailWithOptions("user@example.com", &MailOptions{Extra: []Param{{"X ID", "1"}}}); err == nil {
+		t.Fatalf("Expected invalid keyword to be rejected")
+	}
+	expected := `MAIL FROM:<user@example.com> BODY=8BITMIME X-PRIORITY=high+20value X-FLAG
+RCPT TO:<rcpt@example.com> X-ID=a+2Bb+3Dc
+`
+	if actual := out(); actual != expected {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", actual, expected)
+	}
+}
+
+func TestDataRequiresTLS(t *testing.T) {
+	c, out := newFakeClient(`354 Go ahead
+250 Data OK
+`)
+	c.RequireTLSForData = true
+	if _, err := c.Data(); err != ErrTLSRequiredForData {
+		t.Fatalf("Expected ErrTLSRequiredForData, got %v", err)
+	}
+	if actual := out(); actual != "" {
+		t.Fatalf("Expected no commands on cleartext connection, got:\n%s", actual)
+	}
+	c.tls = true
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("DATA failed: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Bad data response: %s", err)
+	}
+}
+
+func TestVerifyList(t *testing.T) {
+	c, _ := newFakeClient(`553-Ambiguous; Possibilities are
+553-Joe Smith <jsmith@foo.com>
+553 Harry Smith <hsmith@foo.com>
+250-Fred Smith <fred@example.com>
+250 Fred Smithers <freds@example.com>
+`)
+	list, err := c.VerifyList("Smith")
+	if err == nil {
+		t.Fatalf("Expected ambiguous VRFY to fail")
+	}
+	expected := []string{"Ambiguous; Possibilities are", "Joe Smith <jsmith@foo.com>", "Harry Smith <hsmith@foo.com>"}
+	if strings.Join(list, "|") != strings.Join(expected, "|") {
+		t.Fatalf("Got %q, expected %q", list, expected)
+	}
+	list, err = c.VerifyList("Fred")
+	if err != nil {
+		t.Fatalf("VRFY failed: %s", err)
+	}
+	if len(list) != 2 || list[1] != "Fred Smithers <freds@example.com>" {
+		t.Fatalf("Got %q", list)
+	}
+}
+
+func TestExpand(t *testing.T) {
+	c, out := newFakeClient(`250-Jon Postel <Postel@isi.edu>
+250-Fred Fonebone <Fonebone@physics.foo-u.edu>
+250 sam@example.com
+502 5.5.1 EXPN disabled
+`)
+	members, err := c.Expand("Example-People")
+	if err != nil {
+		t.Fatalf("EXPN failed: %s", err)
+	}
+	expected := []string{"Postel@isi.edu", "Fonebone@physics.foo-u.edu", "sam@example.com"}
+	if !reflect.DeepEqual(members, expected) {
+		t.Fatalf("Got %q, expected %q", members, expected)
+	}
+	_, err = c.Expand("staff")
+	var serr *SMTPError
+	if !errors.As(err, &serr) || serr.Code != 502 || serr.EnhancedCode != "5.5.1" {
+		t.Fatalf("Got %v, expected the refusal as *SMTPError", err)
+	}
+	if got, want := out(), "EXPN Example-People\nEXPN staff\n"; got != want {
+		t.Fatalf("Got %q, expected %q", got, want)
+	}
+	if _, err := c.Expand("staff\r\nRSET"); err == nil {
+		t.Fatal("Expected invalid list name to fail")
+	}
+}
+
+func TestHelp(t *testing.T) {
+	c, out := newFakeClient(`214-Commands supported:
+214 HELO EHLO MAIL RCPT DATA
+214 2.0.0 MAIL FROM:<sender> [ <parameters> ]
+502 HELP not implemented
+`)
+	text, err := c.Help("")
+	if err != nil || text != "Commands supported:\nHELO EHLO MAIL RCPT DATA" {
+		t.Fatalf("Got %q, %v", text, err)
+	}
+	if text, err = c.Help("MAIL"); err != nil || text != "2.0.0 MAIL FROM:<sender> [ <parameters> ]" {
+		t.Fatalf("Got %q, %v", text, err)
+	}
+	if _, err = c.Help("RCPT"); err == nil {
+		t.Fatal("Expected 502 to fail")
+	}
+	if got, want := out(), "HELP\nHELP MAIL\nHELP RCPT\n"; got != want {
+		t.Fatalf("Got %q, expected %q", got, want)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	c, out := newFakeClient("250 2.0.0 Ok\n550 5.7.1 Not authorized\n")
+	code, msg, err := c.Command(250, "XCLIENT ADDR=%s", "192.0.2.1")
+	if code != 250 || msg != "2.0.0 Ok" || err != nil {
+		t.Fatalf("Got %d %q, %v", code, msg, err)
+	}
+	code, _, err = c.Command(2, "XFORWARD NAME=%s", "client.example.com")
+	if e, ok := err.(*textproto.Error); code != 550 || !ok || e.Code != 550 {
+		t.Fatalf("Got %d, %v", code, err)
+	}
+	if expected := "XCLIENT ADDR=192.0.2.1\nXFORWARD NAME=client.example.com\n"; out() != expected {
+		t.Errorf("Expected %q", expected)
+	}
+}
+
+func TestRcptForward(t *testing.T) {
+	c, out := newFakeClient("250 Sender OK\n251 User not local; will forward to <b@example.org>\n250 Receiver OK\n550 No such user\n")
+	if err := c.Mail("a@example.com"); err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+	for _, to := range []string{"b@example.com", "c@example.com"} {
+		if err := c.Rcpt(to); err != nil {
+			t.Fatalf("RCPT %s failed: %s", to, err)
+		}
+	}
+	if err := c.Rcpt("d@example.com"); err == nil {
+		t.Fatal("Expected 550 to fail")
+	}
+	if expected := "MAIL FROM:<a@example.com>\nRCPT TO:<b@example.com>\nRCPT TO:<c@example.com>\nRCPT TO:<d@example.com>\n"; out() != expected {
+		t.Errorf("Expected %q", expected)
+	}
+}
+
+func TestSendResult(t *testing.T) {
+	c, _ := newFakeClient(`250 Sender OK
+250 Receiver OK
+251 User not local; will forward
+354 Go ahead
+250 2.0.0 Ok: queued as 4F3C21E1A3
+`)
+	res := &SendResult{}
+	err := c.send(nil, nil, "user@example.com", []string{"a@example.com", "b@example.com"}, bytes.NewReader([]byte("Subject: test\r\n\r\nbody\r\n")), 0, &SendOptions{}, res)
+	if err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	if res.QueueID != "4F3C21E1A3" {
+		t.Errorf("Got queue id %q", res.QueueID)
+	}
+	if len(res.Recipients) != 2 || res.Recipients[0].Code != 250 || res.Recipients[1].Code != 251 {
+		t.Errorf("Unexpected recipient results %+v", res.Recipients)
+	}
+	if res.TLS != nil || res.AuthMechanism != "" {
+		t.Errorf("Expected no TLS and no authentication, got %+v", res)
+	}
+}
+
+func TestQuitWithoutReply(t *testing.T) {
+	c, out := newFakeClient("")
+	if err := c.Quit(); err != nil {
+		t.Fatalf("QUIT without 221 should succeed, got %s", err)
+	}
+	if actual := out(); actual != "QUIT\n" {
+		t.Fatalf("Got %q", actual)
+	}
+
+	c, _ = newFakeClient("500 What?\n")
+	if err := c.Quit(); err == nil {
+		t.Fatalf("Expected QUIT to fail on error reply")
+	}
+
+	c, out = newFakeClient("500 What?\n")
+	c.AsyncQuit = true
+	if err := c.Quit(); err != nil {
+		t.Fatalf("Asynchronous QUIT should not wait for the reply, got %s", err)
+	}
+	if actual := out(); actual != "QUIT\n" {
+		t.Fatalf("Got %q", actual)
+	}
+}
+
+func TestQuitIdempotent(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		tc := textproto.NewConn(serverConn)
+		tc.PrintfLine("220 hello world")
+		tc.ReadLine()
+		tc.PrintfLine("250 mx.example.com")
+		tc.ReadLine()
+		// close right after the reply
+		tc.PrintfLine("221 Bye")
+		serverConn.Close()
+	}()
+	c, _, err := NewClient(clientConn, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatalf("QUIT failed: %s", err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Errorf("Second QUIT failed: %s", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("Close after QUIT failed: %s", err)
+	}
+
+	c, out := newFakeClient("")
+	c.Close()
+	if err := c.Quit(); err != nil || out() != "" {
+		t.Errorf("QUIT after Close: %v, sent %q", err, out())
+	}
+}
+
+func TestPing(t *testing.T) {
+	c, out := newFakeClient("250 Ok\n502 5.5.1 Not implemented\n421 4.4.2 Idle for too long\n")
+	for i, alive := range []bool{true, true, false, false} {
+		if err := c.Ping(); (err == nil) != alive || !alive && !errors.Is(err, ErrConnClosed) {
+			t.Errorf("Ping %d: got %v, expected alive %v", i, err, alive)
+		}
+	}
+	if expected := "NOOP\nNOOP\nNOOP\nNOOP\n"; out() != expected {
+		t.Errorf("Expected %q", expected)
+	}
+	c.Close()
+	if err := c.Ping(); err != ErrConnClosed {
+		t.Errorf("Ping after Close: got %v", err)
+	}
+}
+
+func TestSendDSNPerRecipient(t *testing.T) {
+	c, out := newFakeClient(`250 Sender OK
+250 Receiver OK
+250 Receiver OK
+250 Receiver OK
+354 Go ahead
+250 Data OK
+`)
+	c.ext = map[string]string{"DSN": ""}
+	to := []string{"a@example.com", "b+tag@example.com", "c=d@example.com"}
+	err := c.send(nil, nil, "user@example.com", to, bytes.NewReader([]byte("body\r\n")), 0, &SendOptions{Notify: []string{"FAILURE", "DELAY"}}, &SendResult{})
+	if err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	expected := `MAIL FROM:<user@example.com>
+RCPT TO:<a@example.com> NOTIFY=FAILURE,DELAY ORCPT=rfc822;a@example.com
+RCPT TO:<b+tag@example.com> NOTIFY=FAILURE,DELAY ORCPT=rfc822;b+2Btag@example.com
+RCPT TO:<c=d@example.com> NOTIFY=FAILURE,DELAY ORCPT=rfc822;c+3Dd@example.com
+DATA
+body
+.
+`
+	if actual := out(); actual != expected {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", actual, expected)
+	}
+}
+
+func TestMailDSN(t *testing.T) {
+	for _, dsn := range []bool{true, false} {
+		c, out := newFakeClient("250 Sender OK\n250 Receiver OK\n")
+		c.ext = map[string]string{}
+		if dsn {
+			c.ext["DSN"] = ""
+		}
+		if err := c.MailWithOptions("user@example.com", &MailOptions{Return: ReturnHeaders, EnvID: "id+1"}); err != nil {
+			t.Fatalf("MAIL failed: %s", err)
+		}
+		if err := c.RcptDSN("a@example.com", []string{"SUCCESS", "FAILURE"}, "a@example.com"); err != nil {
+			t.Fatalf("RCPT failed: %s", err)
+		}
+		expected := "MAIL FROM:<user@example.com>\nRCPT TO:<a@example.com>\n"
+		if dsn {
+			expected = "MAIL FROM:<user@example.com> RET=HDRS ENVID=id+2B1\nRCPT TO:<a@example.com> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;a@example.com\n"
+		}
+		if actual := out(); actual != expected {
+			t.Errorf("DSN %v: got %q, expected %q", dsn, actual, expected)
+		}
+	}
+
+	c, _ := newFakeClient("")
+	if err := c.MailWithOptions("user@example.com", &MailOptions{Return: "ALL"}); err == nil {
+		t.Errorf("Invalid RET value accepted")
+	}
+}
+
+func TestRcptInvalidNotify(t *testing.T) {
+	for _, notify := range [][]string{
+		{"FAILURE\r\nRSET"},
+		{"SUCCESS", "ALWAYS"},
+		{NotifyNever, NotifyFailure},
+	} {
+		c, out := newFakeClient("")
+		c.ext = map[string]string{"DSN": ""}
+		if err := c.RcptDSN("a@example.com", notify, ""); err == nil {
+			t.Errorf("NOTIFY %q accepted", notify)
+		}
+		if sent := out(); sent != "" {
+			t.Errorf("NOTIFY %q: sent %q", notify, sent)
+		}
+	}
+}
+
+func TestSMTPUTF8(t *testing.T) {
+	c, out := newFakeClient("250 Sender OK\n250 Reset OK\n250 Sender OK\n250 Receiver OK\n")
+	c.ext = map[string]string{"SMTPUTF8": ""}
+	if err := c.Mail("user@example.com"); err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+	if err := c.Rcpt("иван@example.com"); !errors.Is(err, ErrSMTPUTF8Required) {
+		t.Errorf("Expected ErrSMTPUTF8Required without SMTPUTF8 in MAIL, got %v", err)
+	}
+	c.AutoReset = true
+	if err := c.MailWithOptions("user@example.com", &MailOptions{UTF8: true}); err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+	if err := c.Rcpt("иван@example.com"); err != nil {
+		t.Fatalf("RCPT failed: %s", err)
+	}
+	if expected := "MAIL FROM:<user@example.com>\nRSET\nMAIL FROM:<user@example.com> SMTPUTF8\nRCPT TO:<иван@example.com>\n"; out() != expected {
+		t.Errorf("Expected %q", expected)
+	}
+
+	c, out = newFakeClient("")
+	c.ext = map[string]string{}
+	if err := c.Mail("иван@example.com"); !errors.Is(err, ErrSMTPUTF8Required) {
+		t.Errorf("Expected ErrSMTPUTF8Required, got %v", err)
+	}
+	if out() != "" {
+		t.Errorf("Sent a non-ASCII address to a server without SMTPUTF8")
+	}
+}
+
+func TestMailRequireTLS(t *testing.T) {
+	c, out := newFakeClient("250 Sender OK\n")
+	c.ext = map[string]string{}
+	if err := c.MailRequireTLS("user@example.com"); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Expected ErrNotSupported, got %v", err)
+	}
+	c.ext["REQUIRETLS"] = ""
+	if err := c.MailRequireTLS("user@example.com"); err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+	if expected := "MAIL FROM:<user@example.com> REQUIRETLS\n"; out() != expected {
+		t.Errorf("Expected %q", expected)
+	}
+}
+
+func TestEnhancedCode(t *testing.T) {
+	tests := map[string]string{
+		"2.0.0 Ok: queued as 4F3C21E1A3":                    "2.0.0",
+		"5.1.1 <x@example.com>: Recipient address rejected": "5.1.1",
+		"4.3.2\nsecond line":                                "4.3.2",
+		"4.7.100 too many":                                  "4.7.100",
+		"Sender OK":                                         "",
+		"3.1.1 bad class":                                   "",
+		"2.0 short":                                         "",
+		"":                                                  "",
+	}
+	for msg, expected := range tests {
+		if got := enhancedCode(msg); got != expected {
+			t.Errorf("enhancedCode(%q) = %q, expected %q", msg, got, expected)
+		}
+	}
+}
+
+type upperWriter struct {
+	io.Writer
+}
+
+func (u upperWriter) Write(p []byte) (int, error) {
+	return u.Writer.Write(bytes.ToUpper(p))
+}
+
+func TestDataRaw(t *testing.T) {
+	c, out := newFakeClient(`354 Go ahead
+250 Data OK
+`)
+	w, done, err := c.DataRaw()
+	if err != nil {
+		t.Fatalf("DATA failed: %s", err)
+	}
+	if _, err := (upperWriter{w}).Write([]byte("Subject: x\n\n.dot\n")); err != nil {
+		t.Fatalf("Data write failed: %s", err)
+	}
+	if err := done(); err != nil {
+		t.Fatalf("Bad data response: %s", err)
+	}
+	expected := `DATA
+SUBJECT: X
+
+..DOT
+.
+`
+	if actual := out(); actual != expected {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", actual, expected)
+	}
+}
+
+func TestBareLF(t *testing.T) {
+	server := "220 hello world\n250 lmtp.example.com\n250 Sender OK\n354 Go ahead\n250 Data OK\n"
+	var cmdbuf bytes.Buffer
+	bcmdbuf := bufio.NewWriter(&cmdbuf)
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+	c, _, err := NewClient(fake, "fake.host", WithBareLF())
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if err := c.Mail("user@example.com"); err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("DATA failed: %s", err)
+	}
+	w.Write([]byte("Subject: x\r\n\r\nkeep\rthis\n"))
+	if err := w.Close(); err != nil {
+		t.Fatalf("Bad data response: %s", err)
+	}
+	bcmdbuf.Flush()
+	expected := "EHLO localhost\nMAIL FROM:<user@example.com>\nDATA\nSubject: x\n\nkeep\rthis\n.\n"
+	if actual := cmdbuf.String(); actual != expected {
+		t.Fatalf("Got %q, expected %q", actual, expected)
+	}
+}
+
+func TestProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 25}
+	tests := []struct {
+		h    ProxyHeader
+		want string
+	}{
+		{ProxyHeader{Version: 1, Source: src, Destination: dst}, "PROXY TCP4 192.0.2.1 198.51.100.7 56324 25\r\n"},
+		{ProxyHeader{Version: 1}, "PROXY UNKNOWN\r\n"},
+		{ProxyHeader{Version: 2, Source: src, Destination: dst},
+			"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c\xc0\x00\x02\x01\xc6\x33\x64\x07\xdc\x04\x00\x19"},
+		{ProxyHeader{Version: 2}, "\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00"},
+	}
+	for i, tt := range tests {
+		server := "220 hello world\r\n250 mx.example.com\r\n"
+		var cmdbuf bytes.Buffer
+		bcmdbuf := bufio.NewWriter(&cmdbuf)
+		var fake faker
+		fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+		if _, _, err := NewClient(fake, "fake.host", WithProxyHeader(&tt.h)); err != nil {
+			t.Fatalf("%d: NewClient: %v", i, err)
+		}
+		bcmdbuf.Flush()
+		if want := tt.want + "EHLO localhost\r\n"; cmdbuf.String() != want {
+			t.Errorf("%d: got %q, want %q", i, cmdbuf.String(), want)
+		}
+	}
+
+	h := ProxyHeader{Version: 3}
+	if _, err := h.encode(src, dst); err == nil {
+		t.Error("unsupported version accepted")
+	}
+}
+
+func TestCommandHook(t *testing.T) {
+	server := "220 hello world\r\n250 mx.example.com\r\n250 Sender OK\r\n"
+	var cmdbuf bytes.Buffer
+	bcmdbuf := bufio.NewWriter(&cmdbuf)
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+	var verbs []string
+	errInjected := errors.New("injected")
+	hook := func(verb, args string) (string, error) {
+		verbs = append(verbs, verb)
+		switch verb {
+		case "MAIL":
+			return verb + " " + strings.ToLower(args), nil
+		case "RCPT":
+			return "", errInjected
+		}
+		return verb + " " + args, nil
+	}
+	c, _, err := NewClient(fake, "fake.host", WithCommandHook(hook))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if err := c.Mail("User@Example.com"); err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+	if err := c.Rcpt("rcpt@example.com"); err != errInjected {
+		t.Fatalf("RCPT: got %v, want injected error", err)
+	}
+	bcmdbuf.Flush()
+	expected := "EHLO localhost\r\nMAIL from:<user@example.com>\r\n"
+	if actual := cmdbuf.String(); actual != expected {
+		t.Fatalf("Got %q, expected %q", actual, expected)
+	}
+	if got := strings.Join(verbs, " "); got != "EHLO MAIL RCPT" {
+		t.Errorf("hook saw %q", got)
+	}
+
+	// BDAT lines pass the hook, which may abort the transfer
+	for _, fail := range []bool{false, true} {
+		c, out := newFakeClient("250 2.0.0 OK\n")
+		c.ext = map[string]string{"CHUNKING": ""}
+		var lines []string
+		c.CommandHook = func(verb, args string) (string, error) {
+			lines = append(lines, verb+" "+args)
+			if fail {
+				return "", errInjected
+			}
+			return verb + " " + args, nil
+		}
+		w, err := c.Bdat()
+		if err != nil {
+			t.Fatalf("BDAT failed: %s", err)
+		}
+		io.WriteString(w, "body\r\n")
+		err = w.Close()
+		if fail && err != errInjected || !fail && err != nil {
+			t.Errorf("fail %v: Close returned %v", fail, err)
+		}
+		if got := strings.Join(lines, "|"); got != "BDAT 6 LAST" {
+			t.Errorf("fail %v: hook saw %q", fail, got)
+		}
+		expected := "BDAT 6 LAST\nbody\n"
+		if fail {
+			expected = ""
+		}
+		if sent := out(); sent != expected {
+			t.Errorf("fail %v: sent %q, expected %q", fail, sent, expected)
+		}
+	}
+}
+
+func TestReadReplies(t *testing.T) {
+	server := "250 Sender OK\n550 No such user\n250-Recipient\n250 OK\n250 Reset\n"
+	c, _ := newFakeClient(server)
+	var ids []uint
+	for _, cmd := range []string{"MAIL FROM:<a@example.com>", "RCPT TO:<b@example.com>", "RCPT TO:<c@example.com>", "RSET", "NOOP"} {
+		id, err := c.Text.Cmd("%s", cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	replies := c.ReadReplies(ids, []int{250, 25, 25, 250, 250})
+	want := []struct {
+		code int
+		msg  string
+	}{{250, "Sender OK"}, {550, "No such user"}, {250, "Recipient\nOK"}, {250, "Reset"}, {0, ""}}
+	for i, r := range replies {
+		if r.Code != want[i].code || r.Msg != want[i].msg {
+			t.Errorf("reply %d: got %d %q, want %d %q", i, r.Code, r.Msg, want[i].code, want[i].msg)
+		}
+	}
+	if replies[1].Err == nil || replies[2].Err != nil {
+		t.Errorf("RCPT errors: %v, %v", replies[1].Err, replies[2].Err)
+	}
+	if replies[3].Err != nil {
+		t.Errorf("RSET: %v", replies[3].Err)
+	}
+	if replies[4].Err == nil {
+		t.Error("missing reply without error")
+	}
+	if _, _, err := c.cmd(250, "NOOP"); err == nil {
+		t.Error("NOOP after the batch succeeded without a reply")
+	}
+}
+
+func TestSpool(t *testing.T) {
+	msg := "Subject: spool\r\n\r\nbody\r\n"
+	for _, limit := range []int64{1 << 10, int64(len(msg)), 8} {
+		s, err := newSpool(strings.NewReader(msg), limit)
+		if err != nil {
+			t.Fatalf("limit %d: %v", limit, err)
+		}
+		if (s.file != nil) != (limit < int64(len(msg))) {
+			t.Errorf("limit %d: spilled to file: %v", limit, s.file != nil)
+		}
+		b, _ := io.ReadAll(s.Reader())
+		if string(b) != msg || s.size != int64(len(msg)) {
+			t.Errorf("limit %d: got %q (%d bytes)", limit, b, s.size)
+		}
+		if err := s.Close(); err != nil {
+			t.Errorf("limit %d: Close: %v", limit, err)
+		}
+	}
+}
+
+func TestSendMailReader(t *testing.T) {
+	d := &fakeDialer{server: `220 hello world
+250-mx.example.com
+250 SIZE 1000
+250 Sender OK
+250 Receiver OK
+354 Go ahead
+250 Data OK
+221 Bye
+`}
+	msg := "Subject: spool\r\n\r\nbody\r\n"
+	opts := &SendOptions{ClientOptions: []Option{WithDialer(d)}, SpoolMemory: 8}
+	res, err := SendMailReader("mx.example.com:25", nil, nil, "a@example.com", []string{"b@example.com"}, io.MultiReader(strings.NewReader(msg)), opts)
+	if err != nil {
+		t.Fatalf("SendMailReader: %v", err)
+	}
+	if want := fmt.Sprintf("MAIL FROM:<a@example.com> SIZE=%d\r\n", len(msg)); !strings.Contains(string(res.Transcript), want) {
+		t.Errorf("transcript lacks %q:\n%s", want, res.Transcript)
+	}
+	if want := []string{fmt.Sprintf("SIZE=%d", len(msg))}; !reflect.DeepEqual(res.MailParams, want) {
+		t.Errorf("Got MAIL parameters %q, expected %q", res.MailParams, want)
+	}
+}
+
+func TestMessageTooLarge(t *testing.T) {
+	c, out := newFakeClient("250 Sender OK\n")
+	c.ext = map[string]string{"SIZE": "10"}
+	if err := c.MailSize("a@example.com", 11); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("Expected ErrMessageTooLarge, got %v", err)
+	}
+	if err := c.MailSize("a@example.com", 10); err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+	if expected := "MAIL FROM:<a@example.com> SIZE=10\n"; out() != expected {
+		t.Errorf("Expected only %q to be sent", expected)
+	}
+
+	d := &fakeDialer{server: "220 hello world\n250-mx.example.com\n250 SIZE 4\n"}
+	_, err := SendMailWithOptions("mx.example.com:25", nil, nil, "a@example.com", []string{"b@example.com"}, []byte("body\r\n"), &SendOptions{ClientOptions: []Option{WithDialer(d)}})
+	if !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("Expected ErrMessageTooLarge, got %v", err)
+	}
+}
+
+func TestSendLocal(t *testing.T) {
+	accept := "220 hello world\n250 localhost\n250 Sender OK\n250 Receiver OK\n354 Go ahead\n250 Data OK\n221 Bye\n"
+	d := &mapDialer{servers: map[string]string{"localhost:25": accept}}
+	if err := sendLocal("a@example.com", []string{"b@example.com"}, []byte("body\r\n"), []Option{WithDialer(d)}); err != nil {
+		t.Fatalf("sendLocal: %v", err)
+	}
+	if expected := []string{"localhost:587", "localhost:25"}; !reflect.DeepEqual(d.dialed, expected) {
+		t.Errorf("Dialed %v, expected %v", d.dialed, expected)
+	}
+
+	for _, reply := range []string{"530 5.7.0 Authentication required\n", "250 Sender OK\n550 5.1.1 No such user\n"} {
+		d = &mapDialer{servers: map[string]string{"localhost:587": "220 hello world\n250 localhost\n" + reply, "localhost:25": accept}}
+		if err := sendLocal("a@example.com", []string{"b@example.com"}, []byte("body\r\n"), []Option{WithDialer(d)}); err != nil {
+			t.Errorf("sendLocal with %q on 587: %v", reply, err)
+		}
+		if expected := []string{"localhost:587", "localhost:25"}; !reflect.DeepEqual(d.dialed, expected) {
+			t.Errorf("Dialed %v with %q on 587, expected %v", d.dialed, reply, expected)
+		}
+	}
+
+	// a failed QUIT after the message was accepted must not send it again
+	for _, reply := range []string{"554 5.6.0 Message rejected\n", "250 Data OK\n500 QUIT failed\n"} {
+		d = &mapDialer{servers: map[string]string{"localhost:587": "220 hello world\n250 localhost\n250 Sender OK\n250 Receiver OK\n354 Go ahead\n" + reply, "localhost:25": accept}}
+		if err := sendLocal("a@example.com", []string{"b@example.com"}, []byte("body\r\n"), []Option{WithDialer(d)}); err == nil {
+			t.Errorf("Expected the error after %q on 587 to be returned", reply)
+		}
+		if len(d.dialed) != 1 {
+			t.Errorf("Fell back after the message data was sent: %v", d.dialed)
+		}
+	}
+}
+
+type addrDialer map[string]Dialer
+
+func (d addrDialer) Dial(network, addr string) (net.Conn, error) {
+	if dd, ok := d[addr]; ok {
+		return dd.Dial(network, addr)
+	}
+	return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+}
+
+func TestSendLocalSelfSigned(t *testing.T) {
+	config := testTLSConfig(t)
+	newServer := func() *tlsPipeDialer {
+		return &tlsPipeDialer{
+			config:   config,
+			pre:      []string{"250-localhost", "250 STARTTLS"},
+			post:     []string{"250 localhost"},
+			received: make(chan []string, 1),
+		}
+	}
+	submission, relay := newServer(), newServer()
+	submission.tcp = true
+	d := addrDialer{"localhost:587": submission, "localhost:25": relay}
+	if err := sendLocal("a@example.com", []string{"b@example.com"}, []byte("body\r\n"), []Option{WithDialer(d)}); err != nil {
+		t.Fatalf("sendLocal: %v", err)
+	}
+	if received := <-submission.received; strings.Join(received, "") != "" {
+		t.Errorf("Port 587 received %q despite the failed verification", received)
+	}
+	if received := <-relay.received; len(received) == 0 || received[0] != "MAIL FROM:<a@example.com>" {
+		t.Errorf("Port 25 received %q, expected the message", received)
+	}
+}
+
+type errDialer struct{ err error }
+
+func (d errDialer) Dial(network, addr string) (net.Conn, error) { return nil, d.err }
+
+func TestSendErrorStages(t *testing.T) {
+	send := func(server string) error {
+		opts := &SendOptions{ClientOptions: []Option{WithDialer(&fakeDialer{server: server})}}
+		_, err := SendMailWithOptions("mx.example.com:25", nil, nil, "a@example.com", []string{"b@example.com"}, []byte("body\r\n"), opts)
+		return err
+	}
+
+	var merr *MailError
+	if err := send("220 hello world\n250 mx.example.com\n451 4.3.0 Try again\n"); !errors.As(err, &merr) {
+		t.Errorf("Expected MailError, got %v", err)
+	}
+	var rerr *RcptError
+	var serr *SMTPError
+	err := send("220 hello world\n250 mx.example.com\n250 Sender OK\n550 5.1.1 No such user\n")
+	if !errors.As(err, &rerr) || rerr.Addr != "b@example.com" || !errors.As(err, &serr) || serr.Code != 550 {
+		t.Errorf("Expected RcptError for b@example.com with the 550 reply, got %v", err)
+	}
+	var derr *DataError
+	err = send("220 hello world\n250 mx.example.com\n250 Sender OK\n250 Receiver OK\n354 Go ahead\n")
+	if !errors.As(err, &derr) || !errors.Is(err, ErrNetwork) {
+		t.Errorf("Expected DataError wrapping ErrNetwork, got %v", err)
+	}
+}
+
+func TestSendMailPartial(t *testing.T) {
+	server := "220 hello world\n250 mx.example.com\n250 Sender OK\n550 5.1.1 No such user\n250 Receiver OK\n354 Go ahead\n250 Data OK\n221 Bye\n"
+	opts := &SendOptions{ClientOptions: []Option{WithDialer(&fakeDialer{server: server})}, AllowPartial: true}
+	res, err := SendMailWithOptions("mx.example.com:25", nil, nil, "a@example.com", []string{"bad@example.com", "b@example.com"}, []byte("body\r\n"), opts)
+	if err != nil {
+		t.Fatalf("SendMailWithOptions: %v", err)
+	}
+	if len(res.Recipients) != 2 || res.Recipients[0].Code != 550 || res.Recipients[0].Err == nil || res.Recipients[1].Err != nil {
+		t.Errorf("Unexpected recipient results %+v", res.Recipients)
+	}
+
+	server = "220 hello world\n250 mx.example.com\n250 Sender OK\n550 5.1.1 No such user\n450 4.2.1 Try again later\n"
+	opts.ClientOptions = []Option{WithDialer(&fakeDialer{server: server})}
+	_, err = SendMailWithOptions("mx.example.com:25", nil, nil, "a@example.com", []string{"bad@example.com", "b@example.com"}, []byte("body\r\n"), opts)
+	var serr *SMTPError
+	if !errors.Is(err, ErrRecipientRejected) || !errors.As(err, &serr) || serr.Code != 450 {
+		t.Errorf("Expected ErrRecipientRejected with the last rejection, got %v", err)
+	}
+}
+
+func TestSendErrorTypes(t *testing.T) {
+	send := func(d Dialer) error {
+		opts := &SendOptions{ClientOptions: []Option{WithDialer(d)}}
+		_, err := SendMailWithOptions("mx.example.com:25", nil, nil, "a@example.com", []string{"b@example.com"}, []byte("body\r\n"), opts)
+		return err
+	}
+
+	err := send(&fakeDialer{server: "220 hello world\n250 mx.example.com\n450 4.2.1 Try again later\n"})
+	var serr *SMTPError
+	if !errors.As(err, &serr) || serr.Code != 450 || serr.EnhancedCode != "4.2.1" || !serr.Temporary() {
+		t.Errorf("MAIL rejection: got %#v", err)
+	}
+	if errors.Is(err, ErrNetwork) {
+		t.Errorf("MAIL rejection reported as network error")
+	}
+
+	// the server hangs up after the greeting
+	if err := send(&fakeDialer{server: "220 hello world\n250 mx.example.com\n"}); !errors.Is(err, ErrNetwork) || !errors.Is(err, io.EOF) {
+		t.Errorf("hangup: got %v", err)
+	}
+
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	err = send(errDialer{refused})
+	var nerr net.Error
+	if !errors.Is(err, ErrNetwork) || !errors.As(err, &nerr) {
+		t.Errorf("refused: got %v", err)
+	}
+}
+
+func TestSendIfAccepted(t *testing.T) {
+	c, out := newFakeClient(`250 Sender OK
+250 Receiver OK
+550 5.1.1 No such user
+250 Reset OK
+250 Sender OK
+250 Receiver OK
+354 Go ahead
+250 Data OK
+`)
+	res, err := c.SendIfAccepted("a@example.com", []string{"b@example.com", "c@example.com"}, strings.NewReader("body\r\n"))
+	if err != ErrRecipientRejected {
+		t.Fatalf("Expected ErrRecipientRejected, got %v", err)
+	}
+	if len(res) != 2 || res[0].Err != nil || res[1].Code != 550 || res[1].Class != ClassPermanent {
+		t.Fatalf("Got results %+v", res)
+	}
+	res, err = c.SendIfAccepted("a@example.com", []string{"b@example.com"}, strings.NewReader("body\r\n"))
+	if err != nil || len(res) != 1 {
+		t.Fatalf("Second transaction: %v, %+v", err, res)
+	}
+	expected := `MAIL FROM:<a@example.com>
+RCPT TO:<b@example.com>
+RCPT TO:<c@example.com>
+RSET
+MAIL FROM:<a@example.com>
+RCPT TO:<b@example.com>
+DATA
+body
+.
+`
+	if actual := out(); actual != expected {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", actual, expected)
+	}
+}
+
+func TestByteLoggerLimits(t *testing.T) {
+	tests := []struct {
+		maxBytes, maxLines int
+		want               string
+	}{
+		{0, 0, "S: 220 a\nC: EHLO b\nS: 250-c\nS: 250 d\n"},
+		{0, 2, "[truncated]\nS: 250-c\nS: 250 d\n"},
+		{20, 0, "[truncated]\nS: 250-c\nS: 250 d\n"},
+		{28, 3, "[truncated]\nC: EHLO b\nS: 250-c\nS: 250 d\n"},
+		{4, 0, "[truncated]\n0 d\n"},
+	}
+	for _, tt := range tests {
+		w := &ByteLogger{MaxBytes: tt.maxBytes, MaxLines: tt.maxLines}
+		for _, s := range []string{"S: 220 a\n", "C: EHLO b\n", "S: 250-c\nS: 250 d\n"} {
+			w.Write([]byte(s))
+		}
+		if string(w.smtplog) != tt.want {
+			t.Errorf("%d bytes, %d lines: got %q, want %q", tt.maxBytes, tt.maxLines, w.smtplog, tt.want)
+		}
+	}
+}
+
+func TestHeaderOnlyCRLF(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Subject: x\nFrom: a\n\nbin\nary\r\n", "Subject: x\r\nFrom: a\r\n\r\nbin\nary\r\n.\r\n"},
+		{"Subject: x\r\n\r\n.dot\n.\nend", "Subject: x\r\n\r\n..dot\n..\nend\r\n.\r\n"},
+		{"Subject: x\n\nbody\n", "Subject: x\r\n\r\nbody\n\r\n.\r\n"},
+	}
+	for _, tt := range tests {
+		var cmdbuf bytes.Buffer
+		bcmdbuf := bufio.NewWriter(&cmdbuf)
+		var fake faker
+		fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader("354 Go ahead\r\n250 Data OK\r\n")), bcmdbuf)
+		c := &Client{Text: textproto.NewConn(fake), headerOnlyCRLF: true}
+		w, err := c.Data()
+		if err != nil {
+			t.Fatalf("DATA failed: %s", err)
+		}
+		// split writes must not matter
+		for _, b := range []byte(tt.in) {
+			w.Write([]byte{b})
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Bad data response: %s", err)
+		}
+		bcmdbuf.Flush()
+		if actual, want := cmdbuf.String(), "DATA\r\n"+tt.want; actual != want {
+			t.Errorf("%q: got %q, want %q", tt.in, actual, want)
+		}
+	}
+}
+
+func TestByteLoggerRotation(t *testing.T) {
+	var chunks []string
+	w := &ByteLogger{RotateSize: 18, Rotate: func(chunk []byte) { chunks = append(chunks, string(chunk)) }}
+	for _, s := range []string{"S: 220 a\n", "C: EHLO b\n", "S: 250 c\n", "C: QUIT\n"} {
+		w.Write([]byte(s))
+	}
+	if len(chunks) != 1 || chunks[0] != "S: 220 a\nC: EHLO b\n" {
+		t.Errorf("Got chunks %q", chunks)
+	}
+	if string(w.smtplog) != "S: 250 c\nC: QUIT\n" {
+		t.Errorf("Got remaining log %q", w.smtplog)
+	}
+}
+
+func TestLogWriter(t *testing.T) {
+	server := strings.Join(strings.Split("220 hello world\n250 mx.example.com\n", "\n"), "\r\n")
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bufio.NewWriter(io.Discard))
+	var out bytes.Buffer
+	_, bytelog, err := NewClient(fake, "fake.host", WithLogWriter(&out))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if expected := "S: 220 hello world\r\nS: 250 mx.example.com\r\nC: EHLO localhost\r\n"; out.String() != expected {
+		t.Errorf("Got log %q, expected %q", out.String(), expected)
+	}
+	if len(bytelog.smtplog) != 0 {
+		t.Errorf("Log buffered as well: %q", bytelog.smtplog)
+	}
+}
+
+func TestLogProxySplitLines(t *testing.T) {
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader("250 O")), bufio.NewWriter(io.Discard))
+	w := &ByteLogger{}
+	l := &logProxy{Conn: fake, w: w}
+	for _, chunk := range []string{"Subject: te", "st\r\n\r\nline 1\r\nli", "ne 2\r\n"} {
+		l.Write([]byte(chunk))
+	}
+	l.Read(make([]byte, 16))
+	l.Close()
+	expected := "C: Subject: test\r\nC: \r\nC: line 1\r\nC: line 2\r\nS: 250 O\n"
+	if string(w.smtplog) != expected {
+		t.Errorf("Got log %q, expected %q", w.smtplog, expected)
+	}
+}
+
+func TestSourceRoutes(t *testing.T) {
+	tests := []struct {
+		policy SourceRoutePolicy
+		addr   string
+		sent   string
+		err    bool
+	}{
+		{SourceRouteKeep, "@relay.example:user@example.com", "@relay.example:user@example.com", false},
+		{SourceRouteStrip, "@a.example,@b.example:user@example.com", "user@example.com", false},
+		{SourceRouteStrip, "user@example.com", "user@example.com", false},
+		{SourceRouteStrip, "@relay.example user@example.com", "", true},
+		{SourceRouteStrip, "@:user@example.com", "", true},
+		{SourceRouteReject, "@relay.example:user@example.com", "", true},
+		{SourceRouteReject, "user@example.com", "user@example.com", false},
+	}
+	for _, tt := range tests {
+		c, out := newFakeClient("250 Receiver OK\n")
+		c.SourceRoutes = tt.policy
+		err := c.Rcpt(tt.addr)
+		if tt.err != errors.Is(err, ErrSourceRoute) {
+			t.Errorf("%d %q: got error %v", tt.policy, tt.addr, err)
+		}
+		expected := ""
+		if !tt.err {
+			expected = "RCPT TO:<" + tt.sent + ">\n"
+		}
+		if actual := out(); actual != expected {
+			t.Errorf("%d %q: sent %q, expected %q", tt.policy, tt.addr, actual, expected)
+		}
+	}
+}
+
+func TestAddressSyntax(t *testing.T) {
+	tests := []struct {
+		syntax   AddressSyntax
+		expected string
+	}{
+		{AddressBracketed, "MAIL FROM:<>\nRCPT TO:<b@example.com>\n"},
+		{AddressBare, "MAIL FROM:<>\nRCPT TO:b@example.com\n"},
+		{AddressSpaceBare, "MAIL FROM: <>\nRCPT TO: b@example.com\n"},
+		{AddressSpaceBracketed, "MAIL FROM: <>\nRCPT TO: <b@example.com>\n"},
+	}
+	for _, tt := range tests {
+		c, out := newFakeClient("250 Sender OK\n250 Receiver OK\n")
+		c.AddressSyntax = tt.syntax
+		if err := c.Mail(""); err != nil {
+			t.Fatalf("%d: MAIL failed: %s", tt.syntax, err)
+		}
+		if err := c.Rcpt("b@example.com"); err != nil {
+			t.Fatalf("%d: RCPT failed: %s", tt.syntax, err)
+		}
+		if actual := out(); actual != tt.expected {
+			t.Errorf("%d: sent %q, expected %q", tt.syntax, actual, tt.expected)
+		}
+	}
+}
+
+func TestNoop(t *testing.T) {
+	c, out := newFakeClient("250 2.0.0 OK\n421 4.4.2 Idle timeout\n")
+	if err := c.Noop(); err != nil {
+		t.Fatalf("NOOP failed: %s", err)
+	}
+	if err := c.Noop(); err == nil || !c.Closing() {
+		t.Fatalf("Expected NOOP to fail and the client to be closing, got %v", err)
+	}
+	if expected := "NOOP\nNOOP\n"; out() != expected {
+		t.Errorf("Expected %q", expected)
+	}
+}
+
+func TestVerifyStatus(t *testing.T) {
+	c, _ := newFakeClient("250 <a@example.com>\n252 Cannot VRFY user, but will accept message\n550 No such user\n")
+	for _, tt := range []struct {
+		verified, fails bool
+	}{{true, false}, {false, false}, {false, true}} {
+		verified, err := c.VerifyStatus("a@example.com")
+		if verified != tt.verified || (err != nil) != tt.fails {
+			t.Errorf("Got %v, %v, expected %v, failure %v", verified, err, tt.verified, tt.fails)
+		}
+	}
+}
+
+func TestTransactionAlreadyOpen(t *testing.T) {
+	c, out := newFakeClient("250 Sender OK\n250 Reset OK\n250 Sender OK\n")
+	if err := c.Mail("a@example.com"); err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+	if err := c.Mail("b@example.com"); err != ErrTransactionAlreadyOpen {
+		t.Fatalf("Expected ErrTransactionAlreadyOpen, got %v", err)
+	}
+	c.AutoReset = true
+	if err := c.Mail("b@example.com"); err != nil {
+		t.Fatalf("MAIL with AutoReset failed: %s", err)
+	}
+	expected := "MAIL FROM:<a@example.com>\nRSET\nMAIL FROM:<b@example.com>\n"
+	if actual := out(); actual != expected {
+		t.Fatalf("Got %q, expected %q", actual, expected)
+	}
+}
+
+func TestBurl(t *testing.T) {
+	c, out := newFakeClient("250 Sender OK\n250 Receiver OK\n250 2.5.0 Waiting for more\n250 2.5.0 Ok\n")
+	if err := c.Burl("imap://user@imap.example.com/Drafts;UIDVALIDITY=1/;UID=20;urlauth=submit+user:internal:91354a473744909de610943775f92038", true); !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("Expected ErrNotSupported, got %v", err)
+	}
+	c.ext = map[string]string{"BURL": "imap"}
+	if err := c.Mail("a@example.com"); err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+	if err := c.Rcpt("b@example.com"); err != nil {
+		t.Fatalf("RCPT failed: %s", err)
+	}
+	if err := c.Burl("imap://imap.example.com/Drafts;UID=20/;section=1", false); err != nil {
+		t.Fatalf("BURL failed: %s", err)
+	}
+	if err := c.Burl("imap://imap.example.com/Drafts;UID=20/;section=2", true); err != nil {
+		t.Fatalf("BURL LAST failed: %s", err)
+	}
+	if c.inTransaction {
+		t.Errorf("Transaction still open after BURL LAST")
+	}
+	if err := c.Burl("imap://a b", true); err == nil {
+		t.Errorf("URL with space accepted")
+	}
+	expected := "MAIL FROM:<a@example.com>\nRCPT TO:<b@example.com>\nBURL imap://imap.example.com/Drafts;UID=20/;section=1\nBURL imap://imap.example.com/Drafts;UID=20/;section=2 LAST\n"
+	if actual := out(); actual != expected {
+		t.Fatalf("Got %q, expected %q", actual, expected)
+	}
+}
+
+func TestMailAuthParam(t *testing.T) {
+	c, out := newFakeClient("250 Sender OK\n250 Reset OK\n250 Sender OK\n250 Reset OK\n250 Sender OK\n250 Reset OK\n")
+	c.ext = map[string]string{"AUTH": "PLAIN"}
+	for _, opts := range []*MailOptions{{AuthSender: "e=mc2@example.com"}, {AuthUnknown: true}, {}} {
+		if err := c.MailWithOptions("a@example.com", opts); err != nil {
+			t.Fatalf("MAIL failed: %s", err)
+		}
+		c.Reset()
+	}
+	expected := "MAIL FROM:<a@example.com> AUTH=e+3Dmc2@example.com\nRSET\nMAIL FROM:<a@example.com> AUTH=<>\nRSET\nMAIL FROM:<a@example.com>\nRSET\n"
+	if actual := out(); actual != expected {
+		t.Fatalf("Got %q, expected %q", actual, expected)
+	}
+}
+
+func TestMailAuth(t *testing.T) {
+	for _, advertised := range []bool{true, false} {
+		c, out := newFakeClient("250 Sender OK\n250 Reset OK\n250 Sender OK\n250 Reset OK\n")
+		c.ext = map[string]string{}
+		if advertised {
+			c.ext["AUTH"] = "PLAIN"
+		}
+		for _, authAs := range []string{"user@example.com", "<>"} {
+			if err := c.MailAuth("a@example.com", authAs); err != nil {
+				t.Fatalf("MAIL failed: %s", err)
+			}
+			c.Reset()
+		}
+		expected := "MAIL FROM:<a@example.com>\nRSET\nMAIL FROM:<a@example.com>\nRSET\n"
+		if advertised {
+			expected = "MAIL FROM:<a@example.com> AUTH=user@example.com\nRSET\nMAIL FROM:<a@example.com> AUTH=<>\nRSET\n"
+		}
+		if actual := out(); actual != expected {
+			t.Errorf("AUTH %v: got %q, expected %q", advertised, actual, expected)
+		}
+	}
+}
+
+func TestPhaseTimings(t *testing.T) {
+	d := &fakeDialer{server: "220 hello world\n250 mx.example.com\n250 Sender OK\n250 Receiver OK\n354 Go ahead\n250 Data OK\n221 Bye\n"}
+	res, err := SendMailWithOptions("mx.example.com:25", nil, nil, "a@example.com", []string{"b@example.com"}, []byte("body\r\n"), &SendOptions{ClientOptions: []Option{WithDialer(d)}})
+	if err != nil {
+		t.Fatalf("SendMailWithOptions: %v", err)
+	}
+	for _, phase := range []string{PhaseConnect, PhaseGreeting, PhaseEHLO, PhaseMail, PhaseRcpt, PhaseData} {
+		if _, ok := res.PhaseTimings[phase]; !ok {
+			t.Errorf("Phase %s not timed", phase)
+		}
+	}
+	for _, phase := range []string{PhaseSTARTTLS, PhaseAuth} {
+		if _, ok := res.PhaseTimings[phase]; ok {
+			t.Errorf("Phase %s timed but not reached", phase)
+		}
+	}
+}
+
+func TestLocalName(t *testing.T) {
+	server := "220 hello world\r\n250 mx.example.com\r\n502 EHLO not implemented\r\n250 mx.example.com\r\n"
+	var fake faker
+	var cmdbuf bytes.Buffer
+	bcmdbuf := bufio.NewWriter(&cmdbuf)
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+	c, bytelog, err := NewClient(fake, "fake.host", WithLocalName("client.example.com"))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if err := c.Hello("mail.example.com"); err != nil {
+		t.Fatalf("Hello: %v", err)
+	}
+	if err := c.Hello("bad name"); err == nil {
+		t.Errorf("Invalid local name accepted")
+	}
+	bcmdbuf.Flush()
+	expected := "EHLO client.example.com\r\nEHLO mail.example.com\r\nHELO mail.example.com\r\n"
+	if actual := cmdbuf.String(); actual != expected {
+		t.Fatalf("Got %q, expected %q", actual, expected)
+	}
+	if !bytes.Contains(bytelog.smtplog, []byte("C: EHLO client.example.com")) {
+		t.Errorf("Local name missing from log:\n%s", bytelog.smtplog)
+	}
+}
+
+func TestLocalNameInjection(t *testing.T) {
+	var fake faker
+	var cmdbuf bytes.Buffer
+	bcmdbuf := bufio.NewWriter(&cmdbuf)
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader("220 hello world\r\n250 mx.example.com\r\n")), bcmdbuf)
+	if _, _, err := NewClient(fake, "fake.host", WithLocalName("evil\r\nRSET")); err == nil {
+		t.Errorf("Invalid local name accepted")
+	}
+	bcmdbuf.Flush()
+	if cmdbuf.Len() != 0 {
+		t.Errorf("Sent %q", cmdbuf.String())
+	}
+}
+
+func TestAuthDecisions(t *testing.T) {
+	server := "220 hello world\n250-mx.example.com\n250 AUTH LOGIN PLAIN CRAM-MD5\n334 PDEyMz4=\n235 Accepted\n250 Sender OK\n250 Receiver OK\n354 Go ahead\n250 Data OK\n221 Bye\n"
+	opts := &SendOptions{ClientOptions: []Option{WithDialer(&fakeDialer{server: server})}}
+	res, err := SendMailWithOptions("mx.example.com:25", PlainAuth("", "user", "pass", "mx.example.com"), CRAMMD5Auth("user", "secret"), "a@example.com", []string{"b@example.com"}, []byte("body\r\n"), opts)
+	if err != nil {
+		t.Fatalf("SendMailWithOptions: %v", err)
+	}
+	expected := []AuthDecision{{"LOGIN", AuthSkippedWeaker}, {"PLAIN", AuthSkippedWeaker}, {"CRAM-MD5", AuthSelected}}
+	if !reflect.DeepEqual(res.AuthDecisions, expected) {
+		t.Errorf("Got %v, expected %v", res.AuthDecisions, expected)
+	}
+
+	// without TLS, the Auth refuses and the session fails
+	server = "220 hello world\n250-mx.example.com\n250 AUTH LOGIN PLAIN CRAM-MD5\n221 Bye\n"
+	for _, tt := range []struct {
+		aplain   Auth
+		expected []AuthDecision
+	}{
+		{PlainAuth("", "user", "pass", "mx.example.com"), []AuthDecision{{"LOGIN", AuthSkippedUnsupported}, {"PLAIN", AuthSkippedInsecure}, {"CRAM-MD5", AuthSkippedNoCredentials}}},
+		{LoginAuth("user", "pass", "mx.example.com"), []AuthDecision{{"LOGIN", AuthSkippedInsecure}, {"PLAIN", AuthSkippedUnsupported}, {"CRAM-MD5", AuthSkippedNoCredentials}}},
+	} {
+		opts = &SendOptions{ClientOptions: []Option{WithDialer(&fakeDialer{server: server})}}
+		res, err = SendMailWithOptions("mx.example.com:25", tt.aplain, nil, "a@example.com", []string{"b@example.com"}, []byte("body\r\n"), opts)
+		if !errors.Is(err, ErrInsecureAuth) {
+			t.Errorf("Expected ErrInsecureAuth, got %v", err)
+		}
+		if !reflect.DeepEqual(res.AuthDecisions, tt.expected) {
+			t.Errorf("Got %v, expected %v", res.AuthDecisions, tt.expected)
+		}
+	}
+
+	// over TLS, the mechanism of the Auth given as aplain is selected
+	c, _ := newFakeClient("334 VXNlcm5hbWU6\n334 UGFzc3dvcmQ6\n235 Accepted\n")
+	c.serverName, c.tls = "mx.example.com", true
+	c.ext = map[string]string{"AUTH": "LOGIN PLAIN"}
+	c.auth = []string{"LOGIN", "PLAIN"}
+	res = &SendResult{}
+	if err := c.authenticate(LoginAuth("user", "pass", "mx.example.com"), nil, &SendOptions{}, res); err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	expected = []AuthDecision{{"LOGIN", AuthSelected}, {"PLAIN", AuthSkippedUnsupported}}
+	if !reflect.DeepEqual(res.AuthDecisions, expected) || res.AuthMechanism != "LOGIN" {
+		t.Errorf("Got %v using %q, expected %v using LOGIN", res.AuthDecisions, res.AuthMechanism, expected)
+	}
+}
+
+func TestDataTee(t *testing.T) {
+	var tee bytes.Buffer
+	c, out := newFakeClient("354 Go ahead\n250 Data OK\n")
+	c.DataTee = &tee
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("DATA failed: %s", err)
+	}
+	io.WriteString(w, "Subject: test\n\n.hidden\n")
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+	if expected := "Subject: test\r\n\r\n..hidden\r\n.\r\n"; tee.String() != expected {
+		t.Errorf("Teed %q, expected %q", tee.String(), expected)
+	}
+	if expected := "DATA\nSubject: test\n\n..hidden\n.\n"; out() != expected {
+		t.Errorf("Expected %q to be sent", expected)
+	}
+}
+
+func TestDialTimeoutGreeting(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		// accept, but never greet
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+	start := time.Now()
+	_, _, err = DialTimeout(l.Addr().String(), 50*time.Millisecond)
+	var nerr net.Error
+	if !errors.As(err, &nerr) || !nerr.Timeout() {
+		t.Fatalf("Expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Gave up after %v", elapsed)
+	}
+}
+
+func TestDialFrom(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Listen: %v", err)
+	}
+	defer l.Close()
+	remote := make(chan net.Addr, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			remote <- nil
+			return
+		}
+		defer conn.Close()
+		remote <- conn.RemoteAddr()
+		tc := textproto.NewConn(conn)
+		tc.PrintfLine("220 hello world")
+		tc.ReadLine()
+		tc.PrintfLine("250 localhost")
+		tc.ReadLine()
+	}()
+	c, _, err := DialFrom("127.0.0.1", l.Addr().String())
+	if err != nil {
+		t.Fatalf("DialFrom: %v", err)
+	}
+	defer c.Close()
+	if addr, ok := (<-remote).(*net.TCPAddr); !ok || !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Connected from %v", addr)
+	}
+	for _, bad := range []string{"", "localhost", "127.0.0.1:x", "127.0.0.1:70000"} {
+		if _, _, err := DialFrom(bad, l.Addr().String()); err == nil {
+			t.Errorf("Local address %q accepted", bad)
+		}
+	}
+}
+
+// stepReader returns one line of a server script per Read, calling
+// check before each line is returned.
+type stepReader struct {
+	lines []string
+	check func(line string)
+}
+
+func (r *stepReader) Read(p []byte) (int, error) {
+	if len(r.lines) == 0 {
+		return 0, io.EOF
+	}
+	line := r.lines[0]
+	r.check(line)
+	r.lines = r.lines[1:]
+	return copy(p, line+"\r\n"), nil
+}
+
+func TestSendPipelining(t *testing.T) {
+	var cmdbuf bytes.Buffer
+	server := &stepReader{
+		lines: strings.Split(`220 hello world
+250-mx.example.com
+250 PIPELINING
+250 Sender OK
+550 No such user
+250 Receiver OK
+354 Go ahead
+250 Data OK
+221 OK`, "\n"),
+		check: func(line string) {
+			if line == "250 Sender OK" && !strings.HasSuffix(cmdbuf.String(), "RCPT TO:<c@example.com>\r\n") {
+				t.Errorf("MAIL reply read before all RCPT commands were sent: %q", cmdbuf.String())
+			}
+		},
+	}
+	var fake faker
+	// unbuffered, so the check sees what was sent
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriterSize(&cmdbuf, 1))
+	start := time.Now()
+	c, _, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	res := &SendResult{}
+	err = c.send(nil, nil, "user@example.com", []string{"b@example.com", "c@example.com"}, strings.NewReader("body\r\n"), 0, &SendOptions{AllowPartial: true}, res)
+	if _, err = c.finish(res, start, err); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	expected := "EHLO localhost\r\nMAIL FROM:<user@example.com>\r\nRCPT TO:<b@example.com>\r\nRCPT TO:<c@example.com>\r\nDATA\r\nbody\r\n.\r\nQUIT\r\n"
+	if got := cmdbuf.String(); got != expected {
+		t.Errorf("Got %q, expected %q", got, expected)
+	}
+	if len(res.Recipients) != 2 || res.Recipients[0].Code != 550 || res.Recipients[1].Code != 250 {
+		t.Errorf("Recipients: %+v", res.Recipients)
+	}
+}
+
+func TestPipelineCommandHook(t *testing.T) {
+	server := strings.Join(strings.Split(`220 hello world
+250-mx.example.com
+250 PIPELINING
+250 Sender OK
+250 Receiver OK
+354 Go ahead
+250 Data OK
+221 OK
+`, "\n"), "\r\n")
+	var cmdbuf bytes.Buffer
+	bcmdbuf := bufio.NewWriter(&cmdbuf)
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+	var verbs []string
+	hook := func(verb, args string) (string, error) {
+		verbs = append(verbs, verb)
+		if args == "" {
+			return verb, nil
+		}
+		return verb + " " + strings.ToLower(args), nil
+	}
+	c, _, err := NewClient(fake, "fake.host", WithCommandHook(hook))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	res := &SendResult{}
+	err = c.send(nil, nil, "User@Example.com", []string{"B@Example.com"}, strings.NewReader("body\r\n"), 0, &SendOptions{}, res)
+	if _, err = c.finish(res, time.Now(), err); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	bcmdbuf.Flush()
+	expected := "EHLO localhost\r\nMAIL from:<user@example.com>\r\nRCPT to:<b@example.com>\r\nDATA\r\nbody\r\n.\r\nQUIT\r\n"
+	if got := cmdbuf.String(); got != expected {
+		t.Errorf("Got %q, expected %q", got, expected)
+	}
+	if got := strings.Join(verbs, " "); got != "EHLO MAIL RCPT DATA" {
+		t.Errorf("hook saw %q", got)
+	}
+}
+
+func TestSendStatistics(t *testing.T) {
+	server := strings.Join(strings.Split(`220 hello world
+250 mx.example.com
+250 Sender OK
+250 Receiver OK
+354 Go ahead
+250 Data OK
+221 OK
+`, "\n"), "\r\n")
+	var cmdbuf bytes.Buffer
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bufio.NewWriter(&cmdbuf))
+	start := time.Now()
+	c, _, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	res := &SendResult{}
+	err = c.send(nil, nil, "user@example.com", []string{"a@example.com"}, bytes.NewReader([]byte("body\r\n")), 0, &SendOptions{}, res)
+	if _, err = c.finish(res, start, err); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	expected := "EHLO localhost\r\nMAIL FROM:<user@example.com>\r\nRCPT TO:<a@example.com>\r\nDATA\r\nbody\r\n.\r\nQUIT\r\n"
+	if res.BytesSent != int64(len(expected)) {
+		t.Errorf("Got %d bytes sent, expected %d", res.BytesSent, len(expected))
+	}
+	if res.Elapsed <= 0 || len(res.Transcript) == 0 {
+		t.Errorf("Expected elapsed time and transcript, got %v and %q", res.Elapsed, res.Transcript)
+	}
+}
+
+type fakeDialer struct {
+	server  string
+	network string
+	addr    string
+}
+
+func (d *fakeDialer) Dial(network, addr string) (net.Conn, error) {
+	d.network, d.addr = network, addr
+	var fake faker
+	server := strings.Join(strings.Split(d.server, "\n"), "\r\n")
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bufio.NewWriter(io.Discard))
+	return fake, nil
+}
+
+func TestDialProxy(t *testing.T) {
+	proxy := &fakeDialer{server: "220 hello world\n250 mx.example.com\n"}
+	c, _, err := DialProxy("mx.example.com:25", proxy, WithDialer(&fakeDialer{}), WithNetwork("tcp4"))
+	if err != nil {
+		t.Fatalf("DialProxy: %v", err)
+	}
+	if proxy.network != "tcp4" || proxy.addr != "mx.example.com:25" {
+		t.Fatalf("Proxy dialed %s %s", proxy.network, proxy.addr)
+	}
+	if c.serverName != "mx.example.com" {
+		t.Fatalf("Got server name %q", c.serverName)
+	}
+}
+
+func TestHostOf(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"mx.example.com:25":   "mx.example.com",
+		"192.0.2.1:465":       "192.0.2.1",
+		"[2001:db8::1]:465":   "2001:db8::1",
+		"mx.example.com":      "mx.example.com",
+		"/var/run/smtpd.sock": "/var/run/smtpd.sock",
+	} {
+		if got := hostOf(addr); got != expected {
+			t.Errorf("hostOf(%q) = %q, expected %q", addr, got, expected)
+		}
+	}
+}
+
+func TestGreeting(t *testing.T) {
+	d := &fakeDialer{server: "220-mx.example.com ESMTP Postfix (Debian/GNU)\n220 id 42\n250 mx.example.com\n"}
+	c, _, err := Dial("mx.example.com:25", WithDialer(d))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	if expected := "mx.example.com ESMTP Postfix (Debian/GNU)\nid 42"; c.Greeting() != expected {
+		t.Errorf("Got %q, expected %q", c.Greeting(), expected)
+	}
+}
+
+func TestDialNetwork(t *testing.T) {
+	d := &fakeDialer{server: "220 hello world\n250 mx.example.com\n"}
+	c, _, err := Dial("mx.example.com:25", WithDialer(d), WithNetwork("tcp6"))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	if d.network != "tcp6" || d.addr != "mx.example.com:25" {
+		t.Fatalf("Dialed %s %s", d.network, d.addr)
+	}
+	if c.serverName != "mx.example.com" {
+		t.Fatalf("Got server name %q", c.serverName)
+	}
+	if _, ok := c.Conn().(faker); !ok {
+		t.Fatalf("Expected Conn to return the dialed connection, got %T", c.Conn())
+	}
+	if _, _, err := Dial("mx.example.com:25", WithDialer(d)); err != nil || d.network != "tcp" {
+		t.Fatalf("Expected default network tcp, got %s (%v)", d.network, err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	c, out := newFakeClient("250 Receiver OK\n")
+	c.ext = map[string]string{"DSN": "", "LIMITS": "RCPTMAX=100 MAILMAX=1000 BOGUS"}
+	l := c.Limits()
+	if l != (Limits{MailLine: 612, RcptLine: 1012, MailMax: 1000, RcptMax: 100}) {
+		t.Fatalf("Unexpected limits %+v", l)
+	}
+
+	long := strings.Repeat("x", 600) + "@example.com"
+	err := c.MailWithOptions(long, nil)
+	if !errors.Is(err, ErrCommandTooLong) {
+		t.Fatalf("Expected ErrCommandTooLong, got %v", err)
+	}
+	// RCPT may be longer when DSN is supported
+	if err := c.Rcpt(long); err != nil {
+		t.Fatalf("RCPT failed: %s", err)
+	}
+	if actual := out(); actual != "RCPT TO:<"+long+">\n" {
+		t.Fatalf("Got:\n%s", actual)
+	}
+}
+
+// testTLSConfig returns a server configuration with a self-signed
+// certificate for localhost.
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// serveSTARTTLS plays a server on conn that upgrades to TLS and answers
+// QUIT, reporting failures on errc.
+func serveSTARTTLS(conn net.Conn, config *tls.Config, errc chan<- error) {
+	tc := textproto.NewConn(conn)
+	tc.PrintfLine("220 hello world")
+	tc.ReadLine()
+	tc.PrintfLine("250-localhost")
+	tc.PrintfLine("250 STARTTLS")
+	if line, _ := tc.ReadLine(); line != "STARTTLS" {
+		errc <- errors.New("expected STARTTLS, got " + line)
+		return
+	}
+	tc.PrintfLine("220 Go ahead")
+	tlsConn := tls.Server(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		errc <- err
+		return
+	}
+	tc = textproto.NewConn(tlsConn)
+	tc.ReadLine()
+	tc.PrintfLine("250 localhost")
+	tc.ReadLine()
+	tc.PrintfLine("221 OK")
+	// wait for the client's close_notify
+	io.Copy(io.Discard, tlsConn)
+	conn.Close()
+	errc <- nil
+}
+
+func TestStartTLSInjection(t *testing.T) {
+	server := "220 hello world\r\n250-localhost\r\n250 STARTTLS\r\n220 Go ahead\r\n250-injected\r\n250 AUTH PLAIN\r\n"
+	// the reply filter reads ahead on its own
+	for _, opts := range [][]Option{nil, {WithReplyFilter(LenientReply)}} {
+		var cmdbuf bytes.Buffer
+		bcmdbuf := bufio.NewWriter(&cmdbuf)
+		var fake faker
+		fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+		c, _, err := NewClient(fake, "fake.host", opts...)
+		if err != nil {
+			t.Fatalf("NewClient: %v", err)
+		}
+		err = c.StartTLS(&tls.Config{InsecureSkipVerify: true})
+		if !errors.Is(err, ErrSTARTTLSInjection) {
+			t.Fatalf("%d options: got %v, expected ErrSTARTTLSInjection", len(opts), err)
+		}
+		if c.tls || c.auth != nil {
+			t.Errorf("%d options: upgrade not rejected: TLS %v, AUTH %q", len(opts), c.tls, c.auth)
+		}
+		bcmdbuf.Flush()
+		if expected := "EHLO localhost\r\nSTARTTLS\r\n"; cmdbuf.String() != expected {
+			t.Errorf("%d options: got %q, expected %q", len(opts), cmdbuf.String(), expected)
+		}
+	}
+}
+
+func TestOnTLSHandshake(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	errc := make(chan error, 1)
+	go serveSTARTTLS(serverConn, testTLSConfig(t), errc)
+
+	var states []tls.ConnectionState
+	c, _, err := NewClient(clientConn, "localhost", WithOnTLSHandshake(func(state tls.ConnectionState) {
+		states = append(states, state)
+	}))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if len(states) != 0 {
+		t.Fatalf("Callback called without TLS")
+	}
+	if _, ok := c.TLSConnectionState(); ok {
+		t.Fatalf("TLS state reported without TLS")
+	}
+	if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatalf("STARTTLS failed: %s", err)
+	}
+	if len(states) != 1 || !states[0].HandshakeComplete || len(states[0].PeerCertificates) != 1 {
+		t.Fatalf("Expected one completed handshake, got %d", len(states))
+	}
+	if state, ok := c.TLSConnectionState(); !ok || state.Version != states[0].Version || state.CipherSuite != states[0].CipherSuite {
+		t.Fatalf("Got TLS state %v %+v", ok, state)
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatalf("QUIT failed: %s", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("Server: %s", err)
+	}
+}
+
+// tlsPipeDialer serves a session upgraded with STARTTLS, advertising
+// different extensions before and after the upgrade, or with implicit
+// set, a session using TLS from the start advertising post.
+type tlsPipeDialer struct {
+	config    *tls.Config
+	pre, post []string
+	implicit  bool
+	// tcp connects over loopback TCP instead of net.Pipe, whose lack of
+	// buffering deadlocks handshakes the client aborts
+	tcp bool
+	// commands received after the upgrade
+	received chan []string
+}
+
+func (d *tlsPipeDialer) Dial(network, addr string) (net.Conn, error) {
+	var clientConn, serverConn net.Conn
+	if d.tcp {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		defer l.Close()
+		if clientConn, err = net.Dial("tcp", l.Addr().String()); err != nil {
+			return nil, err
+		}
+		if serverConn, err = l.Accept(); err != nil {
+			clientConn.Close()
+			return nil, err
+		}
+	} else {
+		clientConn, serverConn = net.Pipe()
+	}
+	go func() {
+		defer serverConn.Close()
+		var received []string
+		defer func() { d.received <- received }()
+		tlsConn := tls.Server(serverConn, d.config)
+		tc := textproto.NewConn(tlsConn)
+		if !d.implicit {
+			tc = textproto.NewConn(serverConn)
+		}
+		tc.PrintfLine("220 hello world")
+		tc.ReadLine()
+		if !d.implicit {
+			tc.PrintfLine("%s", strings.Join(d.pre, "\r\n"))
+			if line, _ := tc.ReadLine(); line != "STARTTLS" {
+				return
+			}
+			tc.PrintfLine("220 Go ahead")
+			tc = textproto.NewConn(tlsConn)
+			tc.ReadLine()
+		}
+		tc.PrintfLine("%s", strings.Join(d.post, "\r\n"))
+		for _, reply := range []string{"250 Sender OK", "250 Receiver OK", "354 Go ahead"} {
+			line, _ := tc.ReadLine()
+			received = append(received, line)
+			tc.PrintfLine("%s", reply)
+		}
+		tc.ReadDotLines()
+		tc.PrintfLine("250 Data OK")
+		line, _ := tc.ReadLine()
+		received = append(received, line)
+		tc.PrintfLine("221 Bye")
+		io.Copy(io.Discard, tlsConn)
+	}()
+	return clientConn, nil
+}
+
+func TestCapabilitiesAfterSTARTTLS(t *testing.T) {
+	d := &tlsPipeDialer{
+		config:   testTLSConfig(t),
+		pre:      []string{"250-localhost", "250-8BITMIME", "250-AUTH PLAIN", "250 STARTTLS"},
+		post:     []string{"250-localhost", "250 SIZE 1000000"},
+		received: make(chan []string, 1),
+	}
+	opts := &SendOptions{ClientOptions: []Option{WithDialer(d)}, TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+	res, err := SendMailReader("mx.example.com:25", PlainAuth("", "user", "pass", "mx.example.com"), nil, "a@example.com", []string{"b@example.com"}, strings.NewReader("body\r\n"), opts)
+	if err != nil {
+		t.Fatalf("SendMailReader: %v", err)
+	}
+	received := <-d.received
+	expected := []string{"MAIL FROM:<a@example.com> SIZE=6", "RCPT TO:<b@example.com>", "DATA", "QUIT"}
+	if strings.Join(received, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Got %q, expected %q", received, expected)
+	}
+	if res.AuthMechanism != "" {
+		t.Errorf("Authenticated with %s not advertised after STARTTLS", res.AuthMechanism)
+	}
+}
+
+func TestSendTLSConfig(t *testing.T) {
+	for _, ssl := range []bool{false, true} {
+		d := &tlsPipeDialer{
+			config:   testTLSConfig(t),
+			pre:      []string{"250-localhost", "250 STARTTLS"},
+			post:     []string{"250 localhost"},
+			implicit: ssl,
+			received: make(chan []string, 1),
+		}
+		var pinned bool
+		config := &tls.Config{
+			InsecureSkipVerify: true,
+			MinVersion:         tls.VersionTLS12,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				pinned = len(rawCerts) == 1
+				return nil
+			},
+		}
+		opts := &SendOptions{SSL: ssl, ClientOptions: []Option{WithDialer(d)}, TLSConfig: config}
+		res, err := SendMailWithOptions("mx.example.com:465", nil, nil, "a@example.com", []string{"b@example.com"}, []byte("body\r\n"), opts)
+		if err != nil {
+			t.Fatalf("SSL %v: %v", ssl, err)
+		}
+		<-d.received
+		if !pinned || res.TLS == nil || res.TLS.ServerName != "mx.example.com" {
+			t.Errorf("SSL %v: config not used, pinned %v, TLS %+v", ssl, pinned, res.TLS)
+		}
+		if config.ServerName != "" {
+			t.Errorf("SSL %v: caller's config modified", ssl)
+		}
+	}
+}
+
+// serveReEHLO serves a STARTTLS session whose server rejects the first
+// EHLO after the upgrade with a transient error.
+func serveReEHLO(conn net.Conn, config *tls.Config) {
+	defer conn.Close()
+	tc := textproto.NewConn(conn)
+	tc.PrintfLine("220 hello world")
+	tc.ReadLine()
+	tc.PrintfLine("250-localhost\r\n250-8BITMIME\r\n250 STARTTLS")
+	tc.ReadLine()
+	tc.PrintfLine("220 Go ahead")
+	tlsConn := tls.Server(conn, config)
+	tc = textproto.NewConn(tlsConn)
+	tc.ReadLine()
+	tc.PrintfLine("451 4.3.0 Slow down")
+	if line, _ := tc.ReadLine(); line == "EHLO localhost" {
+		tc.PrintfLine("250-localhost\r\n250 SIZE 1000")
+	}
+	io.Copy(io.Discard, tlsConn)
+}
+
+func TestReEHLOAfterSTARTTLS(t *testing.T) {
+	config := testTLSConfig(t)
+	for _, delay := range []time.Duration{0, time.Millisecond} {
+		clientConn, serverConn := net.Pipe()
+		go serveReEHLO(serverConn, config)
+		c, _, err := NewClient(clientConn, "localhost", WithReEHLODelay(delay))
+		if err != nil {
+			t.Fatalf("NewClient: %v", err)
+		}
+		err = c.StartTLS(&tls.Config{InsecureSkipVerify: true})
+		if delay == 0 {
+			if err == nil {
+				t.Errorf("EHLO rejection ignored")
+			}
+			if ok, _ := c.Extension("8BITMIME"); ok {
+				t.Errorf("Extensions from before STARTTLS kept")
+			}
+		} else if ok, _ := c.Extension("SIZE"); err != nil || !ok {
+			t.Errorf("EHLO not retried: %v", err)
+		}
+		c.Close()
+	}
+}
+
+// seqDialer hands out fake connections replaying the given server
+// scripts in order.
+type seqDialer struct {
+	servers []string
+}
+
+func (d *seqDialer) Dial(network, addr string) (net.Conn, error) {
+	if len(d.servers) == 0 {
+		return nil, errors.New("connection refused")
+	}
+	f := &fakeDialer{server: d.servers[0]}
+	d.servers = d.servers[1:]
+	return f.Dial(network, addr)
+}
+
+func TestPlaintextFallback(t *testing.T) {
+	refusing := "220 hello world\n250-mx.example.com\n250 STARTTLS\n454 TLS not available\n"
+	plain := "220 hello world\n250-mx.example.com\n250 STARTTLS\n250 Sender OK\n250 Receiver OK\n354 Go ahead\n250 Data OK\n221 OK\n"
+
+	d := &seqDialer{[]string{refusing}}
+	_, err := SendMailWithOptions("mx.example.com:25", nil, nil, "a@example.com", []string{"b@example.com"}, []byte("body\r\n"), &SendOptions{ClientOptions: []Option{WithDialer(d)}})
+	if err == nil {
+		t.Fatalf("Expected refused STARTTLS to fail without fallback")
+	}
+
+	d = &seqDialer{[]string{refusing, plain}}
+	res, err := SendMailWithOptions("mx.example.com:25", nil, nil, "a@example.com", []string{"b@example.com"}, []byte("body\r\n"), &SendOptions{ClientOptions: []Option{WithDialer(d)}, PlaintextFallback: true})
+	if err != nil {
+		t.Fatalf("send with fallback failed: %s", err)
+	}
+	if res.TLS != nil || !bytes.Contains(res.Transcript, []byte("454 TLS not available")) || !bytes.Contains(res.Transcript, []byte("250 Data OK")) {
+		t.Fatalf("Unexpected result %+v\n%s", res, res.Transcript)
+	}
+}
+
+func TestDataMissingFinalCRLF(t *testing.T) {
+	for _, msg := range []string{"Subject: x\r\n\r\nno newline", "Subject: x\r\n\r\nbare CR\r", "Subject: x\r\n\r\n."} {
+		c, out := newFakeClient("354 Go ahead\n250 Data OK\n")
+		w, err := c.Data()
+		if err != nil {
+			t.Fatalf("DATA failed: %s", err)
+		}
+		w.Write([]byte(msg))
+		if err := w.Close(); err != nil {
+			t.Fatalf("Bad data response: %s", err)
+		}
+		actual := out()
+		if !strings.HasSuffix(actual, "\n.\n") || strings.Count(actual, "\n.\n") != 1 {
+			t.Errorf("Message %q not terminated correctly:\n%q", msg, actual)
+		}
+	}
+}
+
+func TestSendAuthRequired(t *testing.T) {
+	c, out := newFakeClient("530 5.7.0 Authentication required\n")
+	c.ext = map[string]string{"AUTH": "PLAIN"}
+	err := c.send(nil, nil, "a@example.com", []string{"b@example.com"}, bytes.NewReader(nil), 0, &SendOptions{RequireAuth: true}, &SendResult{})
+	var aerr *AuthError
+	if !errors.Is(err, ErrAuthRequired) || !errors.As(err, &aerr) {
+		t.Fatalf("Expected AuthError wrapping ErrAuthRequired, got %v", err)
+	}
+	if actual := out(); actual != "" {
+		t.Fatalf("Expected no commands, got %q", actual)
+	}
+
+	err = c.send(nil, nil, "a@example.com", []string{"b@example.com"}, bytes.NewReader(nil), 0, &SendOptions{}, &SendResult{})
+	var perr *textproto.Error
+	if !errors.Is(err, ErrAuthRequired) || !errors.As(err, &perr) || perr.Code != 530 {
+		t.Fatalf("Expected ErrAuthRequired wrapping the 530 reply, got %v", err)
+	}
+}
+
+func TestRcptResultClass(t *testing.T) {
+	tests := []struct {
+		code     int
+		msg      string
+		err      error
+		enhanced string
+		class    Class
+	}{
+		{250, "2.1.5 Ok", nil, "2.1.5", ClassUnknown},
+		{550, "5.1.1 <a@example.com>: Recipient address rejected", errors.New("rejected"), "5.1.1", ClassPermanent},
+		{450, "4.2.1 Mailbox busy", errors.New("busy"), "4.2.1", ClassTransient},
+		{550, "4.2.1 enhanced code wins", errors.New("busy"), "4.2.1", ClassTransient},
+		{452, "Too many recipients", errors.New("later"), "", ClassTransient},
+		{0, "", io.EOF, "", ClassUnknown},
+	}
+	for i, test := range tests {
+		r := newRcptResult("a@example.com", test.code, test.msg, test.err)
+		if r.EnhancedCode != test.enhanced || r.Class != test.class {
+			t.Errorf("#%d: got %q/%s, expected %q/%s", i, r.EnhancedCode, r.Class, test.enhanced, test.class)
+		}
+	}
+}
+
+// pipeDialer connects to an in-memory server running script.
+type pipeDialer struct {
+	script func(tc *textproto.Conn)
+}
+
+func (d pipeDialer) Dial(network, addr string) (net.Conn, error) {
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		d.script(textproto.NewConn(serverConn))
+		serverConn.Close()
+	}()
+	return clientConn, nil
+}
+
+func TestPipeTransport(t *testing.T) {
+	var received []string
+	d := pipeDialer{func(tc *textproto.Conn) {
+		tc.PrintfLine("220 hello world")
+		for _, reply := range []string{"250 relay", "250 Sender OK", "250 Receiver OK", "354 Go ahead"} {
+			line, _ := tc.ReadLine()
+			received = append(received, line)
+			tc.PrintfLine("%s", reply)
+		}
+		body, _ := tc.ReadDotLines()
+		received = append(received, body...)
+		tc.PrintfLine("250 Data OK")
+		line, _ := tc.ReadLine()
+		received = append(received, line)
+		tc.PrintfLine("221 OK")
+	}}
+
+	// no port: not every transport uses host:port addresses
+	res, err := SendMailWithOptions("relay", nil, nil, "a@example.com", []string{"b@example.com"}, []byte("Subject: pipe\r\n\r\nbody\r\n"),
+		&SendOptions{ClientOptions: []Option{WithDialer(d)}})
+	if err != nil {
+		t.Fatalf("send over pipe failed: %s", err)
+	}
+	expected := "EHLO localhost|MAIL FROM:<a@example.com>|RCPT TO:<b@example.com>|DATA|Subject: pipe||body|QUIT"
+	if actual := strings.Join(received, "|"); actual != expected {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", actual, expected)
+	}
+	if !bytes.Contains(res.Transcript, []byte("Connected to: pipe")) {
+		t.Fatalf("Unexpected transcript:\n%s", res.Transcript)
+	}
+}
+
+func TestAuthChallengeLimit(t *testing.T) {
+	server := strings.Repeat("334 PDEyMzQ1Njc4OTA+\n", 4) + "501 Aborted\n221 OK\n"
+	c, out := newFakeClient(server)
+	c.MaxAuthChallenges = 3
+	if err := c.Auth(CRAMMD5Auth("user", "pass")); err != ErrTooManyAuthChallenges {
+		t.Fatalf("Expected ErrTooManyAuthChallenges, got %v", err)
+	}
+	actual := out()
+	if strings.Count(actual, "\n") != 6 || !strings.HasSuffix(actual, "*\nQUIT\n") {
+		t.Fatalf("Expected 3 responses followed by abort, got:\n%s", actual)
+	}
+}
+
+// promptAuth answers prompts of a LOGIN-like mechanism and records the
+// challenges it got.
+type promptAuth struct {
+	initial    []byte
+	challenges [][]byte
+}
+
+func (a *promptAuth) Start(server *ServerInfo) (string, []byte, error) {
+	return "LOGIN", a.initial, nil
+}
+
+func (a *promptAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	a.challenges = append(a.challenges, fromServer)
+	return []byte("user"), nil
+}
+
+func TestAuthEmptyChallenge(t *testing.T) {
+	c, out := newFakeClient("334 \n235 Accepted\n")
+	c.tls = true
+	a := &promptAuth{}
+	if err := c.Auth(a); err != nil {
+		t.Fatalf("AUTH failed: %s", err)
+	}
+	if len(a.challenges) != 1 || a.challenges[0] == nil || len(a.challenges[0]) != 0 {
+		t.Errorf("Expected a single empty challenge, got %q", a.challenges)
+	}
+	if expected := "AUTH LOGIN\ndXNlcg==\n"; out() != expected {
+		t.Errorf("Expected %q without initial response", expected)
+	}
+
+	c, out = newFakeClient("235 Accepted\n")
+	c.tls = true
+	if err := c.Auth(&promptAuth{initial: []byte{}}); err != nil {
+		t.Fatalf("AUTH failed: %s", err)
+	}
+	if expected := "AUTH LOGIN =\n"; out() != expected {
+		t.Errorf("Expected %q for an empty initial response", expected)
+	}
+}
+
+// stepClient is a SASLClient answering with canned responses.
+type stepClient struct {
+	responses  []string
+	challenges [][]byte
+}
+
+func (s *stepClient) Step(challenge []byte) ([]byte, bool, error) {
+	s.challenges = append(s.challenges, challenge)
+	if len(s.responses) == 0 {
+		return nil, true, errors.New("unexpected challenge")
+	}
+	resp := s.responses[0]
+	s.responses = s.responses[1:]
+	return []byte(resp), len(s.responses) == 0, nil
+}
+
+func TestSASLAuth(t *testing.T) {
+	c, out := newFakeClient("334 Y2hhbGxlbmdl\n235 Accepted\n")
+	client := &stepClient{responses: []string{"initial", "second"}}
+	if err := c.Auth(SASLAuth("GSSAPI", client)); err != nil {
+		t.Fatalf("AUTH failed: %s", err)
+	}
+	if len(client.challenges) != 2 || client.challenges[0] != nil || string(client.challenges[1]) != "challenge" {
+		t.Errorf("Got challenges %q", client.challenges)
+	}
+	if expected := "AUTH GSSAPI aW5pdGlhbA==\nc2Vjb25k\n"; out() != expected {
+		t.Errorf("Expected %q", expected)
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	d := &fakeDialer{server: "220 hello world\n250-mx.example.com\n250-SIZE 1000000\n250-XCLIENT NAME ADDR\n250 8BITMIME\n"}
+	c, _, err := Dial("mx.example.com:25", WithDialer(d))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	ext := c.Extensions()
+	expected := map[string]string{"SIZE": "1000000", "XCLIENT": "NAME ADDR", "8BITMIME": ""}
+	if !reflect.DeepEqual(ext, expected) {
+		t.Fatalf("Got %q, expected %q", ext, expected)
+	}
+	delete(ext, "SIZE")
+	if ok, _ := c.Extension("SIZE"); !ok {
+		t.Errorf("Extensions does not return a copy")
+	}
+}
+
+func TestAuthMechanisms(t *testing.T) {
+	server := strings.Join(strings.Split("220 hello world\n250-mx.example.com\n250 AUTH LOGIN CRAM-MD5\n334 PDEyMz4=\n235 Accepted\n", "\n"), "\r\n")
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bufio.NewWriter(io.Discard))
+	c, _, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	mechs := c.AuthMechanisms()
+	if !reflect.DeepEqual(mechs, []string{"LOGIN", "CRAM-MD5"}) {
+		t.Fatalf("Got mechanisms %q", mechs)
+	}
+	mechs[0] = "PLAIN"
+	if c.AuthMechanisms()[0] != "LOGIN" {
+		t.Errorf("AuthMechanisms does not return a copy")
+	}
+	if c.AuthMechanism() != "" {
+		t.Errorf("Mechanism reported before Auth")
+	}
+	if err := c.Auth(CRAMMD5Auth("user", "secret")); err != nil {
+		t.Fatalf("AUTH failed: %s", err)
+	}
+	if c.AuthMechanism() != "CRAM-MD5" {
+		t.Errorf("Got mechanism %q, expected CRAM-MD5", c.AuthMechanism())
+	}
+}
+
+func TestAuthFailure(t *testing.T) {
+	c, _ := newFakeClient("535 5.7.8 Authentication credentials invalid\n501 Aborted\n221 OK\n")
+	c.tls = true
+	c.serverName = "testserver"
+	err := c.Auth(PlainAuth("", "user", "wrong", "testserver"))
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 535 {
+		t.Fatalf("Expected 535 error, got %v", err)
+	}
+}
+
+func TestUnsafeLogAuthCredentials(t *testing.T) {
+	for _, unsafe := range []bool{false, true} {
+		server := strings.Join(strings.Split("220 hello world\n250-mx.example.com\n250 AUTH PLAIN\n235 Accepted\n", "\n"), "\r\n")
+		var fake faker
+		fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bufio.NewWriter(io.Discard))
+		var opts []Option
+		if unsafe {
+			opts = append(opts, WithUnsafeLogAuthCredentials())
+		}
+		c, bytelog, err := NewClient(fake, "fake.host", opts...)
+		if err != nil {
+			t.Fatalf("NewClient: %v", err)
+		}
+		c.tls = true
+		if err := c.Auth(PlainAuth("", "user", "pass", "fake.host")); err != nil {
+			t.Fatalf("AUTH failed: %s", err)
+		}
+		if logged := bytes.Contains(bytelog.smtplog, []byte("AHVzZXIAcGFzcw==")); logged != unsafe {
+			t.Errorf("unsafe=%v: credentials logged: %v\n%s", unsafe, logged, bytelog.smtplog)
+		}
+	}
+}
+
+func TestAuthAbortResumesLog(t *testing.T) {
+	server := strings.Join(strings.Split("220 hello world\n250-mx.example.com\n250 AUTH CRAM-MD5\n334 PDEyMz4=\n334 PDEyMz4=\n501 Aborted\n221 Bye\n", "\n"), "\r\n")
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bufio.NewWriter(io.Discard))
+	c, bytelog, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	c.MaxAuthChallenges = 1
+	if err := c.Auth(CRAMMD5Auth("user", "pass")); err != ErrTooManyAuthChallenges {
+		t.Fatalf("Expected ErrTooManyAuthChallenges, got %v", err)
+	}
+	if c.log.authInProgress {
+		t.Error("AUTH still in progress after abort")
+	}
+	if !bytes.Contains(bytelog.smtplog, []byte("C: QUIT\r\n")) {
+		t.Errorf("QUIT missing from log:\n%s", bytelog.smtplog)
+	}
+}
+
+// chunkReader returns at most n bytes per Read, splitting lines.
+type chunkReader struct {
+	r io.Reader
+	n int
+}
+
+func (c chunkReader) Read(p []byte) (int, error) {
+	if len(p) > c.n {
+		p = p[:c.n]
+	}
+	return c.r.Read(p)
+}
+
+func TestAuthLogResumes(t *testing.T) {
+	for _, reply := range []string{"235 2.7.0 Accepted", "235-2.7.0 Welcome\n235 Accepted"} {
+		server := strings.Join(strings.Split(`220 hello world
+250-mx.example.com
+250 AUTH CRAM-MD5
+334 PDEyMz4=
+`+reply+`
+250 Sender OK
+250 Receiver OK
+354 Go ahead
+250 Data OK
+221 OK
+`, "\n"), "\r\n")
+		var fake faker
+		// split the replies across reads
+		fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(chunkReader{strings.NewReader(server), 5}), bufio.NewWriter(io.Discard))
+		c, _, err := NewClient(fake, "fake.host")
+		if err != nil {
+			t.Fatalf("NewClient: %v", err)
+		}
+		res := &SendResult{}
+		err = c.send(nil, CRAMMD5Auth("user", "secret"), "a@example.com", []string{"b@example.com"}, strings.NewReader("body\r\n"), 0, &SendOptions{}, res)
+		if _, err = c.finish(res, time.Now(), err); err != nil {
+			t.Fatalf("send failed: %s", err)
+		}
+		log := string(res.Transcript)
+		if strings.Contains(log, "PDEyMz4=") {
+			t.Errorf("%q: challenge logged:\n%s", reply, log)
+		}
+		for _, want := range []string{"C: Raw log disabled during AUTH\n", "S: 235 ", "C: MAIL FROM:<a@example.com>\r\n", "C: RCPT TO:<b@example.com>\r\n", "C: DATA\r\n", "S: 221 OK\r\n"} {
+			if !strings.Contains(log, want) {
+				t.Errorf("%q: %q missing from log:\n%s", reply, want, log)
+			}
+		}
+	}
+}
+
+func TestAuthLogFraming(t *testing.T) {
+	l := &logProxy{w: &ByteLogger{}}
+	l.logLines("C: ", []byte("auth PLAIN AHVzZXIAcGFzcw==\r\n"))
+	l.logLines("S: ", []byte("454 4.7.0 Temporary authentication failure\r\n"))
+	l.logLines("C: ", []byte("MAIL FROM:<a@example.com>\r\n"))
+	expected := "C: Raw log disabled during AUTH\nS: 454 4.7.0 Temporary authentication failure\r\nC: MAIL FROM:<a@example.com>\r\n"
+	if got := string(l.w.smtplog); got != expected {
+		t.Errorf("Got %q, expected %q", got, expected)
+	}
+}
+
+func TestAuthLogRedaction(t *testing.T) {
+	for _, tt := range []struct {
+		a      Auth
+		mech   string
+		server string
+	}{
+		{PlainAuth("", "user", "secret", "fake.host"), "PLAIN", "235 Accepted\n"},
+		{LoginAuth("user", "secret", "fake.host"), "LOGIN", "334 VXNlcm5hbWU6\n334 UGFzc3dvcmQ6\n235 Accepted\n"},
+		{XOAuth2Auth("user", "secret"), "XOAUTH2", "235 Accepted\n"},
+		{CRAMMD5Auth("user", "secret"), "CRAM-MD5", "334 PDEyMz4=\n535 Rejected\n501 Aborted\n221 Bye\n"},
+	} {
+		server := strings.Join(strings.Split("220 hello world\n250-mx.example.com\n250 AUTH "+tt.mech+"\n"+tt.server, "\n"), "\r\n")
+		var cmdbuf bytes.Buffer
+		bcmdbuf := bufio.NewWriter(&cmdbuf)
+		var fake faker
+		fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+		c, bytelog, err := NewClient(fake, "fake.host")
+		if err != nil {
+			t.Fatalf("NewClient: %v", err)
+		}
+		c.tls = true
+		c.Auth(tt.a)
+		bcmdbuf.Flush()
+		log := string(bytelog.smtplog)
+		if strings.Contains(log, "secret") {
+			t.Errorf("%s: password logged:\n%s", tt.mech, log)
+		}
+		// the AUTH command line with its initial response and all
+		// responses to challenges carry credentials
+		for _, line := range strings.Split(cmdbuf.String(), "\r\n")[1:] {
+			fields := strings.Fields(line)
+			if len(fields) == 0 || fields[len(fields)-1] == tt.mech || line == "*" || line == "QUIT" {
+				continue
+			}
+			if blob := fields[len(fields)-1]; strings.Contains(log, blob) {
+				t.Errorf("%s: %q logged:\n%s", tt.mech, blob, log)
+			}
+		}
+	}
+}
+
+func TestAuthLogSplitWrites(t *testing.T) {
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader("")), bufio.NewWriter(io.Discard))
+	l := &logProxy{Conn: fake, w: &ByteLogger{}}
+	for _, chunk := range []string{"AU", "TH PLAIN AHVz", "ZXIAc2VjcmV0", "\r", "\n"} {
+		l.Write([]byte(chunk))
+	}
+	l.Close()
+	if log := string(l.w.smtplog); log != "C: Raw log disabled during AUTH\n" {
+		t.Errorf("Got %q", log)
+	}
+}
+
+func TestGreetingMode(t *testing.T) {
+	for _, tt := range []struct {
+		server string
+		mode   GreetingMode
+	}{
+		{"220 hello world\n250-mx.example.com\n250 SIZE 1000\n", GreetingEHLO},
+		{"220 hello world\n502 Command not implemented\n250 mx.example.com\n", GreetingHELO},
+	} {
+		var fake faker
+		server := strings.Join(strings.Split(tt.server, "\n"), "\r\n")
+		fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bufio.NewWriter(io.Discard))
+		c, _, err := NewClient(fake, "fake.host")
+		if err != nil {
+			t.Fatalf("NewClient: %v", err)
+		}
+		if c.GreetingMode() != tt.mode {
+			t.Errorf("Got greeting mode %v, want %v", c.GreetingMode(), tt.mode)
+		}
+	}
+}
+
+func TestStrictEHLO(t *testing.T) {
+	var fake faker
+	server := "220 hello world\r\n421 4.3.2 Try again later\r\n250 mx.example.com\r\n"
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bufio.NewWriter(io.Discard))
+	_, _, err := NewClient(fake, "fake.host", WithStrictEHLO())
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 421 {
+		t.Fatalf("Expected the EHLO error, got %v", err)
+	}
+
+	c, _ := newFakeClient("502 Command not implemented\n")
+	c.StrictEHLO = true
+	if err := c.Hello("client.example.com"); err == nil {
+		t.Fatal("Expected Hello to fail without falling back to HELO")
+	}
+}
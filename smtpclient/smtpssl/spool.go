@@ -0,0 +1,83 @@
+//Copyright 2015 NF Design UG (haftungsbeschraenkt)
+//All right reserved.
+
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+
+//  http://www.apache.org/licenses/LICENSE-2.0
+
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package smtpssl
+
+// Buffering messages of unknown length to declare their size
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// DefaultSpoolMemory is the number of bytes SendMailReader buffers in
+// memory before spilling a message to a temporary file.
+const DefaultSpoolMemory = 1 << 20
+
+// spool holds a message read from a non-seekable source, in memory up to
+// a threshold and in a temporary file beyond it.
+type spool struct {
+	mem  bytes.Buffer
+	file *os.File
+	size int64
+}
+
+// newSpool reads r to the end, keeping at most memLimit bytes in memory.
+// The caller has to Close the spool to remove the temporary file.
+func newSpool(r io.Reader, memLimit int64) (*spool, error) {
+	s := &spool{}
+	n, err := io.Copy(&s.mem, io.LimitReader(r, memLimit+1))
+	s.size = n
+	if err != nil || n <= memLimit {
+		return s, err
+	}
+
+	s.file, err = os.CreateTemp("", "smtpssl-spool-")
+	if err != nil {
+		return s, err
+	}
+	if _, err = s.mem.WriteTo(s.file); err != nil {
+		s.Close()
+		return nil, err
+	}
+	n, err = io.Copy(s.file, r)
+	s.size += n
+	if err == nil {
+		_, err = s.file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reader returns the spooled message. It can only be read once.
+func (s *spool) Reader() io.Reader {
+	if s.file != nil {
+		return s.file
+	}
+	return &s.mem
+}
+
+// Close releases the temporary file, if any.
+func (s *spool) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}